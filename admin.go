@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/sloweax/socksx/proxy"
+)
+
+// Admin serves a JSON API to manage the chains of picker
+//
+//	GET    /chains              list chains
+//	POST   /chains              add a chain, body {"chain": "socks5 1.2.3.4:1080"}
+//	GET    /chains/:id          get a chain
+//	DELETE /chains/:id          remove a chain
+//	POST   /chains/:id/disable  take a chain out of rotation
+//	POST   /chains/:id/enable   put a chain back in rotation
+//
+// Requests must have a `Authorization: Bearer <token>` header
+type Admin struct {
+	picker proxy.ChainPicker
+	token  string
+}
+
+// adminToken returns the admin API token from -admin-token, -admin-token-file
+// or $SOCKSX_ADMIN_TOKEN, in that order. Passing it as a flag exposes it to
+// other users of the host
+func adminToken(token, file string) (string, error) {
+	if len(token) != 0 && len(file) != 0 {
+		return "", errors.New("-admin-token and -admin-token-file are mutually exclusive")
+	}
+
+	if len(file) != 0 {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		token = strings.TrimSpace(string(data))
+		if len(token) == 0 {
+			return "", fmt.Errorf("%s is empty", file)
+		}
+	}
+
+	if len(token) == 0 {
+		token = os.Getenv("SOCKSX_ADMIN_TOKEN")
+	}
+
+	if len(token) == 0 {
+		return "", errors.New("-admin requires -admin-token, -admin-token-file or $SOCKSX_ADMIN_TOKEN")
+	}
+
+	return token, nil
+}
+
+type adminChain struct {
+	ID          int     `json:"id"`
+	Chain       string  `json:"chain"`
+	Group       string  `json:"group,omitempty"`
+	Available   bool    `json:"available"`
+	Down        bool    `json:"down"`
+	Disabled    bool    `json:"disabled"`
+	BreakerOpen bool    `json:"breaker_open"`
+	Active      int     `json:"active"`
+	LatencyMS   float64 `json:"latency_ms"`
+	Dials       int     `json:"dials"`
+	Errors      int     `json:"errors"`
+}
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+func newAdminChain(e *proxy.Entry) adminChain {
+	stats := e.Stats()
+	return adminChain{
+		ID:          e.ID,
+		Chain:       e.Chain.String(),
+		Group:       e.Chain.Group(),
+		Available:   e.Available(),
+		Down:        stats.Down,
+		Disabled:    stats.Disabled,
+		BreakerOpen: stats.Open,
+		Active:      stats.Active,
+		LatencyMS:   float64(stats.Latency) / 1e6,
+		Dials:       stats.Dials,
+		Errors:      stats.Errors,
+	}
+}
+
+func (a *Admin) ListenAndServe(address string) error {
+	return http.ListenAndServe(address, a)
+}
+
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		a.error(w, http.StatusUnauthorized, errors.New("invalid token"))
+		return
+	}
+
+	path := strings.Trim(r.URL.Path, "/")
+	parts := strings.Split(path, "/")
+
+	if parts[0] != "chains" || len(parts) > 3 {
+		a.error(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+
+	if len(parts) == 1 {
+		switch r.Method {
+		case http.MethodGet:
+			a.list(w)
+		case http.MethodPost:
+			a.add(w, r)
+		default:
+			a.error(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		}
+		return
+	}
+
+	id, err := strconv.Atoi(parts[1])
+	if err != nil {
+		a.error(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+
+	e := a.picker.Get(id)
+	if e == nil {
+		a.error(w, http.StatusNotFound, errors.New("chain not found"))
+		return
+	}
+
+	if len(parts) == 2 {
+		switch r.Method {
+		case http.MethodGet:
+			a.json(w, http.StatusOK, newAdminChain(e))
+		case http.MethodDelete:
+			a.picker.Remove(id)
+			slog.Info("chain removed by admin", "id", e.ID, "chain", e.Chain.String())
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			a.error(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		}
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		a.error(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	switch parts[2] {
+	case "disable":
+		a.picker.Disable(id)
+		slog.Info("chain disabled by admin", "id", e.ID, "chain", e.Chain.String())
+	case "enable":
+		a.picker.Enable(id)
+		slog.Info("chain enabled by admin", "id", e.ID, "chain", e.Chain.String())
+	default:
+		a.error(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+
+	a.json(w, http.StatusOK, newAdminChain(e))
+}
+
+func (a *Admin) authorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1
+}
+
+func (a *Admin) list(w http.ResponseWriter) {
+	entries := a.picker.All()
+	chains := make([]adminChain, 0, len(entries))
+	for _, e := range entries {
+		chains = append(chains, newAdminChain(e))
+	}
+	a.json(w, http.StatusOK, chains)
+}
+
+func (a *Admin) add(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Chain string `json:"chain"`
+	}
+
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&body); err != nil {
+		a.error(w, http.StatusBadRequest, err)
+		return
+	}
+
+	chain, err := proxy.ParseChain(body.Chain)
+	if err != nil {
+		a.error(w, http.StatusBadRequest, err)
+		return
+	}
+
+	e := a.picker.Add(chain)
+	slog.Info("chain added by admin", "id", e.ID, "chain", e.Chain.String())
+	a.json(w, http.StatusCreated, newAdminChain(e))
+}
+
+func (a *Admin) json(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (a *Admin) error(w http.ResponseWriter, code int, err error) {
+	a.json(w, code, adminError{Error: err.Error()})
+}
@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type Credentials struct {
+	mutex  sync.RWMutex
+	plain  map[string]string
+	hashed map[string][]byte
+}
+
+func (c *Credentials) Add(username, password string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.plain == nil {
+		c.plain = map[string]string{}
+	}
+	delete(c.hashed, username)
+	c.plain[username] = password
+}
+
+func (c *Credentials) AddHash(username string, hash []byte) error {
+	if _, err := bcrypt.Cost(hash); err != nil {
+		return fmt.Errorf("auth: %s: %w", username, err)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.hashed == nil {
+		c.hashed = map[string][]byte{}
+	}
+	delete(c.plain, username)
+	c.hashed[username] = hash
+	return nil
+}
+
+// Load reads htpasswd style `username:bcrypt-hash` lines
+func (c *Credentials) Load(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		username, hash, ok := strings.Cut(line, ":")
+		if !ok || len(username) == 0 {
+			return fmt.Errorf("auth: invalid line `%s`", line)
+		}
+
+		if err := c.AddHash(username, []byte(hash)); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+func (c *Credentials) Len() int {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return len(c.plain) + len(c.hashed)
+}
+
+func (c *Credentials) Authenticate(username, password string) bool {
+	c.mutex.RLock()
+	plain, isplain := c.plain[username]
+	hash, ishashed := c.hashed[username]
+	c.mutex.RUnlock()
+
+	switch {
+	case isplain:
+		return subtle.ConstantTimeCompare([]byte(plain), []byte(password)) == 1
+	case ishashed:
+		return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+	default:
+		return false
+	}
+}
+
+func ParseUserPass(s string) (string, string, error) {
+	username, password, ok := strings.Cut(s, ":")
+	if !ok || len(username) == 0 {
+		return "", "", errors.New("auth: expected `username:password`")
+	}
+	return username, password, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sloweax/socksx/proxy"
+)
+
+type checkResult struct {
+	entry   *proxy.Entry
+	latency time.Duration
+	err     error
+}
+
+// runCheck implements `socksx check`, it dials target through every chain
+// and prints which ones work. Returns the exit code
+func runCheck(args []string) int {
+	var (
+		proxy_files StringArray
+		output      string
+		target      string
+		timeout     time.Duration
+		workers     int
+	)
+
+	fs := flag.NewFlagSet("socksx check", flag.ExitOnError)
+	fs.Var(&proxy_files, "c", "load config file")
+	fs.StringVar(&output, "o", "", "write working chains and routing rules to `file` in config syntax")
+	fs.StringVar(&target, "target", "1.1.1.1:443", "connect to `address` through every chain")
+	fs.DurationVar(&timeout, "timeout", 10*time.Second, "chain connection timeout")
+	fs.IntVar(&workers, "workers", 16, "check x chains at the same time")
+	fs.Parse(args)
+
+	if workers < 1 {
+		fmt.Fprintln(os.Stderr, "-workers must be at least 1")
+		return 2
+	}
+
+	picker := new(proxy.RoundRobin)
+
+	var err error
+	if len(proxy_files) == 0 {
+		err = picker.Reload(os.Stdin)
+	} else {
+		err = reloadConfig(picker, proxy_files)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	// implicit chains of routing rules are not in the config, and reject
+	// chains never connect
+	var (
+		entries []*proxy.Entry
+		keep    = map[*proxy.Entry]bool{}
+	)
+	for _, e := range picker.All() {
+		switch {
+		case e.Chain.Implicit():
+		case e.Chain.Rejects():
+			keep[e] = true
+		default:
+			entries = append(entries, e)
+		}
+	}
+
+	results := checkChains(entries, target, timeout, workers)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	ok := 0
+	for _, r := range results {
+		if r.err != nil {
+			fmt.Fprintf(tw, "%d\tfail\t%s\t%s\t%s\n", r.entry.ID, r.latency.Round(time.Millisecond), r.entry.Chain.String(), r.err)
+			continue
+		}
+		ok += 1
+		keep[r.entry] = true
+		fmt.Fprintf(tw, "%d\tok\t%s\t%s\t\n", r.entry.ID, r.latency.Round(time.Millisecond), r.entry.Chain.String())
+	}
+	tw.Flush()
+
+	fmt.Fprintf(os.Stderr, "%d/%d chains working\n", ok, len(results))
+
+	if len(output) != 0 {
+		if err := writeChecked(output, picker.All(), keep, picker.Rules()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	if ok == 0 {
+		return 1
+	}
+
+	return 0
+}
+
+// checkChains dials target through entries with at most workers at a time.
+// Results are in the same order as entries
+func checkChains(entries []*proxy.Entry, target string, timeout time.Duration, workers int) []checkResult {
+	health := proxy.HealthCheck{Target: target, Timeout: timeout, Workers: workers}
+
+	index := make(map[*proxy.Entry]int, len(entries))
+	for i, e := range entries {
+		index[e] = i
+	}
+
+	results := make([]checkResult, len(entries))
+	health.CheckEntries(context.Background(), entries, func(e *proxy.Entry, latency time.Duration, err error) {
+		results[index[e]] = checkResult{entry: e, latency: latency, err: err}
+	})
+
+	return results
+}
+
+// writeChecked writes the chains of entries in keep and rules to file. Rules
+// whose group has no written chain are left out, unless the group is made
+// of implicit chains which are added again when the file is loaded
+func writeChecked(file string, entries []*proxy.Entry, keep map[*proxy.Entry]bool, rules []proxy.Rule) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+
+	groups := map[string]bool{}
+	for _, e := range entries {
+		if e.Chain.Implicit() {
+			groups[e.Chain.Group()] = true
+			continue
+		}
+		if keep[e] {
+			fmt.Fprintln(w, e.Chain.Format())
+			groups[e.Chain.Group()] = true
+		}
+	}
+
+	for i := range rules {
+		if !groups[rules[i].Group] {
+			fmt.Fprintf(os.Stderr, "%s: group %q has no working chains, skipped\n", rules[i].String(), rules[i].Group)
+			continue
+		}
+		fmt.Fprintln(w, rules[i].Format())
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sloweax/socksx/proxy"
+)
+
+func TestCheckOutput(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	// nothing listens on dead once it is closed
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead.Close()
+
+	tests := []struct {
+		name   string
+		config string
+		code   int
+		want   string
+	}{
+		{
+			name:   "working and dead",
+			config: "direct\nset Group dead | socks5 DEAD\nroute domain example.com dead\n",
+			want:   "direct\n",
+		},
+		{
+			name:   "reject rule",
+			config: "direct\nsocks5 DEAD\nroute port 25 reject\n",
+			want:   "direct\nroute port 25 reject\n",
+		},
+		{
+			name:   "reject group",
+			config: "direct\nset Group blocked | reject\nroute port 25 blocked\n",
+			want:   "direct\nset Group blocked | reject\nroute port 25 blocked\n",
+		},
+		{
+			name:   "only reject",
+			config: "reject\nroute port 25 reject\n",
+			code:   1,
+			want:   "reject\nroute port 25 reject\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			config := filepath.Join(dir, "proxies.conf")
+			output := filepath.Join(dir, "working.conf")
+
+			data := strings.ReplaceAll(tt.config, "DEAD", dead.Addr().String())
+			if err := os.WriteFile(config, []byte(data), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			if code := runCheck([]string{"-c", config, "-o", output, "-target", echo.Addr().String(), "-timeout", "2s"}); code != tt.code {
+				t.Fatalf("got exit code %d, want %d", code, tt.code)
+			}
+
+			b, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := string(b); got != tt.want {
+				t.Fatalf("got output %q, want %q", got, tt.want)
+			}
+
+			picker := new(proxy.RoundRobin)
+			if err := picker.Load(strings.NewReader(string(b))); err != nil {
+				t.Fatalf("output does not parse: %v", err)
+			}
+		})
+	}
+}
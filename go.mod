@@ -1,3 +1,7 @@
 module github.com/sloweax/socksx
 
-go 1.19
+go 1.21
+
+require golang.org/x/crypto v0.31.0
+
+require golang.org/x/sys v0.28.0
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/sloweax/socksx/proxy"
+	"github.com/sloweax/socksx/proxy/http"
+	"github.com/sloweax/socksx/proxy/socks4"
+	"github.com/sloweax/socksx/proxy/socks5"
+)
+
+type Handler struct {
+	picker proxy.ChainPicker
+	groups map[string]string
+	retry  int
+	// if set, chains are pinned to client ip, target host or username
+	sticky     *proxy.Sticky
+	stickymode string
+	access     *accessLog
+	socks4     *socks4.Server
+	socks5     *socks5.Server
+	http       *http.Server
+}
+
+// bufferedConn allows peeking at the first bytes of a connection
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (h *Handler) Serve(conn net.Conn) {
+	defer conn.Close()
+
+	bconn := &bufferedConn{Conn: conn, r: bufio.NewReader(conn)}
+	version, err := bconn.r.Peek(1)
+	if err != nil {
+		slog.Debug("could not read client request", "client", conn.RemoteAddr().String(), "err", err)
+		return
+	}
+
+	var protocol string
+
+	switch version[0] {
+	case socks5.Version:
+		protocol = "socks5"
+	case socks4.Version:
+		protocol = "socks4"
+	default:
+		protocol = "http"
+	}
+
+	connectionsTotal.Add(1, protocol)
+	connectionsActive.Add(1, protocol)
+	defer connectionsActive.Add(-1, protocol)
+
+	switch protocol {
+	case "socks5":
+		h.serveSOCKS5(bconn)
+	case "socks4":
+		h.serveSOCKS4(bconn)
+	default:
+		h.serveHTTP(bconn)
+	}
+}
+
+func (h *Handler) serveSOCKS5(conn net.Conn) {
+	var (
+		err   error
+		rconn net.Conn
+		pconn net.PacketConn
+		bind  net.Listener
+		stats BridgeStats
+	)
+
+	req, err := h.socks5.Handle(conn)
+	if err != nil {
+		handshakeFailures.Add(1, "socks5", handshakeReason(err))
+		slog.Warn("handshake failed", "protocol", "socks5", "client", conn.RemoteAddr().String(), "err", err)
+		return
+	}
+
+	if req.PacketConn != nil {
+		defer req.PacketConn.Close()
+	}
+
+	raddr := req.Addr
+
+	s := newSession("socks5", conn, raddr.String(), req.Username)
+
+	switch req.Cmd {
+	case socks5.CmdUDPAssociate:
+		s.command = "udp"
+	case socks5.CmdBind:
+		s.command = "bind"
+	}
+
+	entry, err := h.withChain(s, func(ctx context.Context, d *proxy.Dialer) error {
+		switch req.Cmd {
+		case socks5.CmdUDPAssociate:
+			pconn, err = d.ListenPacket(ctx)
+			if err != nil {
+				return err
+			}
+			slog.Debug("udp association", "client", s.client.String(), "chain", d.String())
+		case socks5.CmdBind:
+			bind, err = d.Listen(ctx, raddr.String())
+			if err != nil {
+				return err
+			}
+			slog.Debug("bind", "client", s.client.String(), "target", s.target, "address", bind.Addr().String(), "chain", d.String())
+		default:
+			rconn, err = d.DialContext(ctx, "tcp", raddr.String())
+			if err != nil {
+				return err
+			}
+			slog.Debug("connected", "client", s.client.String(), "target", s.target, "chain", d.String())
+		}
+		return nil
+	})
+
+	bnd, _ := socks5.NewAddress(conn.LocalAddr().String())
+
+	if err != nil {
+		h.socks5.Reply(conn, socks5Reply(err), bnd)
+		h.access.Log(s, stats, err)
+		return
+	}
+
+	defer h.picker.Disconnected(entry)
+
+	switch req.Cmd {
+	case socks5.CmdUDPAssociate:
+		defer pconn.Close()
+		relay, _ := socks5.NewAddress(req.PacketConn.LocalAddr().String())
+		err = h.socks5.Reply(conn, socks5.ReplyOK, relay)
+		if err == nil {
+			// the association was routed by its DST.ADDR, datagrams to
+			// targets routed elsewhere (eg. rejected) are dropped
+			group, grouped := h.route(s.target, s.username)
+			err = h.socks5.RelayUDP(conn, req.PacketConn, pconn, func(address string) bool {
+				g, ok := h.route(address, s.username)
+				return ok == grouped && g == group
+			})
+			stats.Closed = "client"
+		}
+	case socks5.CmdBind:
+		defer bind.Close()
+		rconn, err = h.socks5.Bind(conn, bind, raddr)
+		if err == nil {
+			defer rconn.Close()
+			stats, err = Bridge(conn, rconn)
+		}
+	default:
+		defer rconn.Close()
+		err = h.socks5.Reply(conn, socks5.ReplyOK, bnd)
+		if err == nil {
+			stats, err = Bridge(conn, rconn)
+		}
+	}
+
+	h.access.Log(s, stats, err)
+}
+
+func (h *Handler) serveSOCKS4(conn net.Conn) {
+	req, err := h.socks4.Handle(conn)
+	if err != nil {
+		handshakeFailures.Add(1, "socks4", handshakeReason(err))
+		slog.Warn("handshake failed", "protocol", "socks4", "client", conn.RemoteAddr().String(), "err", err)
+		return
+	}
+
+	var (
+		rconn net.Conn
+		stats BridgeStats
+	)
+
+	raddr := req.Addr
+
+	s := newSession("socks4", conn, raddr.String(), "")
+
+	entry, err := h.withChain(s, func(ctx context.Context, d *proxy.Dialer) error {
+		rconn, err = d.DialContext(ctx, "tcp", raddr.String())
+		if err != nil {
+			return err
+		}
+		slog.Debug("connected", "client", s.client.String(), "target", s.target, "chain", d.String())
+		return nil
+	})
+
+	if err != nil {
+		h.socks4.Reply(conn, socks4.ReplyRejected, socks4.LocalAddr(conn))
+		h.access.Log(s, stats, err)
+		return
+	}
+
+	defer h.picker.Disconnected(entry)
+	defer rconn.Close()
+
+	err = h.socks4.Reply(conn, socks4.ReplyOK, socks4.LocalAddr(conn))
+	if err == nil {
+		stats, err = Bridge(conn, rconn)
+	}
+
+	h.access.Log(s, stats, err)
+}
+
+func (h *Handler) serveHTTP(conn *bufferedConn) {
+	req, err := h.http.Handle(conn, conn.r)
+	if err != nil {
+		handshakeFailures.Add(1, "http", handshakeReason(err))
+		slog.Warn("handshake failed", "protocol", "http", "client", conn.RemoteAddr().String(), "err", err)
+		return
+	}
+
+	var (
+		rconn net.Conn
+		stats BridgeStats
+	)
+
+	s := newSession("http", conn, req.Addr, req.Username)
+	if req.Request != nil {
+		s.command = "request"
+	}
+
+	entry, err := h.withChain(s, func(ctx context.Context, d *proxy.Dialer) error {
+		rconn, err = d.DialContext(ctx, "tcp", req.Addr)
+		if err != nil {
+			return err
+		}
+		slog.Debug("connected", "client", s.client.String(), "target", s.target, "chain", d.String())
+		return nil
+	})
+
+	if err != nil {
+		if errors.Is(err, proxy.ErrRejected) {
+			h.http.Reply(conn, 403)
+		} else {
+			h.http.Reply(conn, 502)
+		}
+		h.access.Log(s, stats, err)
+		return
+	}
+
+	defer h.picker.Disconnected(entry)
+	defer rconn.Close()
+
+	// the request read by Handle is forwarded before the rest of the
+	// connection, it counts as sent by the client
+	up := &byteCounter{w: rconn, direction: "up"}
+
+	if req.Request == nil {
+		err = h.http.Reply(conn, 200)
+	} else {
+		err = req.Request.Write(up)
+	}
+
+	if err == nil {
+		stats, err = Bridge(conn, rconn)
+	}
+	stats.Up += up.n
+
+	h.access.Log(s, stats, err)
+}
+
+// socks5Reply returns the reply for requests that failed with err
+func socks5Reply(err error) socks5.Reply {
+	switch {
+	case errors.Is(err, proxy.ErrRejected):
+		return socks5.ReplyConnNotAllowed
+	case errors.Is(err, proxy.ErrUDPMultiHop):
+		return socks5.ReplyCmdNotSupported
+	default:
+		return socks5.ReplyGeneralFailure
+	}
+}
+
+// session describes a client request, used to pick its chain and for the
+// access log
+type session struct {
+	start    time.Time
+	protocol string
+	command  string
+	client   net.Addr
+	target   string
+	username string
+	// last chain tried by withChain and how long it took
+	chain string
+	dial  time.Duration
+}
+
+func newSession(protocol string, conn net.Conn, target, username string) *session {
+	return &session{
+		start:    time.Now(),
+		protocol: protocol,
+		command:  "connect",
+		client:   conn.RemoteAddr(),
+		target:   target,
+		username: username,
+	}
+}
+
+func (h *Handler) stickyKey(s *session) string {
+	switch h.stickymode {
+	case "client":
+		host, _, err := net.SplitHostPort(s.client.String())
+		if err != nil {
+			return s.client.String()
+		}
+		return host
+	case "target":
+		host, _, err := net.SplitHostPort(s.target)
+		if err != nil {
+			return s.target
+		}
+		return host
+	default:
+		return s.username
+	}
+}
+
+// route returns the group connections of username to target go through,
+// grouped is false for the chains without a group
+func (h *Handler) route(target, username string) (string, bool) {
+	if group, ok := h.picker.Route(target); ok {
+		return group, true
+	}
+	group, ok := h.groups[username]
+	return group, ok
+}
+
+// nextChain picks a chain for s. failed are the chains already tried for s,
+// sticky sessions are pinned to another chain instead
+func (h *Handler) nextChain(s *session, failed []*proxy.Entry) (*proxy.Entry, error) {
+	group, grouped := h.route(s.target, s.username)
+
+	var entry *proxy.Entry
+
+	switch {
+	case h.sticky != nil:
+		entry = h.sticky.Next(h.stickyKey(s), group, grouped, failed...)
+	case grouped:
+		entry = h.picker.NextGroup(group)
+	default:
+		entry = h.picker.Next()
+	}
+
+	if entry != nil {
+		return entry, nil
+	}
+
+	if grouped {
+		return nil, fmt.Errorf("group %q has no available chains", group)
+	}
+
+	return nil, errors.New("no available chains")
+}
+
+// withChain calls fn with chains picked for s until it succeeds or
+// the retry limit is reached. On success the returned entry is counted as
+// connected, the caller must call Disconnected once the connection ends
+func (h *Handler) withChain(s *session, fn func(context.Context, *proxy.Dialer) error) (*proxy.Entry, error) {
+	var (
+		err    error
+		entry  *proxy.Entry
+		dialer *proxy.Dialer
+		failed []*proxy.Entry
+	)
+
+	for i := 0; i < h.retry+1; i++ {
+		var (
+			ctx    context.Context
+			cancel context.CancelFunc
+		)
+
+		if i != 0 {
+			retries.Add(1)
+		}
+
+		entry, err = h.nextChain(s, failed)
+		if err != nil {
+			slog.Warn("no chain", "client", s.client.String(), "target", s.target, "err", err)
+			return nil, err
+		}
+
+		chain := entry.Chain
+		s.chain = chain.String()
+
+		dialer, err = chain.ToDialer()
+		if err != nil {
+			slog.Error("invalid chain", "id", entry.ID, "chain", s.chain, "err", err)
+			return nil, err
+		}
+
+		s.chain = dialer.String()
+
+		timeoutstr, ok := chain[0].KWArgs["ChainConnTimeout"]
+		if ok {
+			duration, err := time.ParseDuration(timeoutstr)
+			if err != nil {
+				slog.Error("invalid ChainConnTimeout", "id", entry.ID, "chain", s.chain, "err", err)
+				return nil, err
+			}
+			ctx, cancel = context.WithTimeout(context.Background(), duration)
+		} else {
+			ctx, cancel = context.WithCancel(context.Background())
+		}
+
+		start := time.Now()
+		err = fn(ctx, dialer)
+		cancel()
+
+		elapsed := time.Since(start)
+		s.dial = elapsed
+
+		if errors.Is(err, proxy.ErrRejected) {
+			slog.Debug("rejected", "client", s.client.String(), "target", s.target)
+			return nil, err
+		}
+
+		if errors.Is(err, proxy.ErrUDPMultiHop) {
+			// not a failure of the chain, another one may allow it
+			slog.Debug("udp refused", "id", entry.ID, "chain", s.chain, "err", err)
+			failed = append(failed, entry)
+			continue
+		}
+
+		// the breaker only counts failures of the chain itself
+		var terr *proxy.TargetError
+		if !errors.As(err, &terr) {
+			h.picker.Report(entry, elapsed, err)
+		}
+
+		id := strconv.Itoa(entry.ID)
+		result := "success"
+		if err != nil {
+			result = "failure"
+		}
+		chainDials.Add(1, id, chain.String(), result)
+		chainDialDuration.Observe(elapsed.Seconds(), id, chain.String())
+		if err != nil {
+			slog.Warn("dial failed", "id", entry.ID, "chain", s.chain, "target", s.target, "err", err)
+			failed = append(failed, entry)
+			continue
+		}
+
+		h.picker.Connected(entry)
+		return entry, nil
+	}
+
+	return nil, err
+}
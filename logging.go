@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"text/template"
+	"time"
+)
+
+func newLogHandler(w io.Writer, format, level string) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{}
+
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level `%s`", level)
+	}
+	opts.Level = l
+
+	switch format {
+	case "logfmt":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	default:
+		return nil, fmt.Errorf("unknown log format `%s`", format)
+	}
+}
+
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// accessEntry describes a client request once it is done. Its fields are
+// available to -access-format templates
+type accessEntry struct {
+	Time     time.Time
+	Protocol string
+	Command  string
+	Client   string
+	User     string
+	Target   string
+	Chain    string
+	Dial     time.Duration
+	Up       int64
+	Down     int64
+	Duration time.Duration
+	Reason   string
+}
+
+// accessLog logs an entry per client request. If tmpl is set entries are
+// written to w with it, otherwise they are logged with slog
+type accessLog struct {
+	tmpl  *template.Template
+	w     io.Writer
+	mutex sync.Mutex
+}
+
+func newAccessLog(w io.Writer, format string) (*accessLog, error) {
+	l := &accessLog{w: w}
+	if len(format) == 0 {
+		return l, nil
+	}
+
+	tmpl, err := template.New("access").Parse(format)
+	if err != nil {
+		return nil, err
+	}
+	l.tmpl = tmpl
+
+	return l, nil
+}
+
+// Log logs s, err is the error that ended it if any
+func (l *accessLog) Log(s *session, stats BridgeStats, err error) {
+	e := accessEntry{
+		Time:     s.start,
+		Protocol: s.protocol,
+		Command:  s.command,
+		Client:   s.client.String(),
+		User:     s.username,
+		Target:   s.target,
+		Chain:    s.chain,
+		Dial:     s.dial,
+		Up:       stats.Up,
+		Down:     stats.Down,
+		Duration: time.Since(s.start),
+	}
+
+	switch {
+	case err != nil:
+		e.Reason = err.Error()
+	case len(stats.Closed) != 0:
+		e.Reason = stats.Closed + " closed"
+	default:
+		e.Reason = "closed"
+	}
+
+	if l.tmpl == nil {
+		slog.Info("access",
+			"protocol", e.Protocol,
+			"command", e.Command,
+			"client", e.Client,
+			"user", e.User,
+			"target", e.Target,
+			"chain", e.Chain,
+			"dial", e.Dial,
+			"up", e.Up,
+			"down", e.Down,
+			"duration", e.Duration,
+			"reason", e.Reason,
+		)
+		return
+	}
+
+	buf := bytes.Buffer{}
+	if err := l.tmpl.Execute(&buf, e); err != nil {
+		slog.Error("access log template failed", "err", err)
+		return
+	}
+	buf.WriteByte('\n')
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.w.Write(buf.Bytes())
+}
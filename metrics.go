@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/sloweax/socksx/metrics"
+	httpproxy "github.com/sloweax/socksx/proxy/http"
+	"github.com/sloweax/socksx/proxy/socks4"
+	"github.com/sloweax/socksx/proxy/socks5"
+)
+
+var (
+	registry = new(metrics.Registry)
+
+	connectionsActive = registry.NewGauge("socksx_client_connections_active", "Open client connections.", "protocol")
+	connectionsTotal  = registry.NewCounter("socksx_client_connections_total", "Accepted client connections.", "protocol")
+	handshakeFailures = registry.NewCounter("socksx_handshake_failures_total", "Failed client handshakes.", "protocol", "reason")
+	chainDials        = registry.NewCounter("socksx_chain_dials_total", "Connections made through chains.", "id", "chain", "result")
+	chainDialDuration = registry.NewHistogram("socksx_chain_dial_duration_seconds", "Time taken to connect through chains.", metrics.DefaultBuckets, "id", "chain")
+	retries           = registry.NewCounter("socksx_retries_total", "Connections retried with another chain.")
+	bytesTotal        = registry.NewCounter("socksx_bytes_total", "Bytes relayed between clients and chains.", "direction")
+)
+
+func serveMetrics(address string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", registry)
+	return http.ListenAndServe(address, mux)
+}
+
+// handshakeReason classifies client handshake errors
+func handshakeReason(err error) string {
+	var neterr net.Error
+
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	case errors.As(err, &neterr) && neterr.Timeout():
+		return "timeout"
+	case errors.Is(err, socks5.ErrAuthFailed), errors.Is(err, httpproxy.ErrAuthFailed), errors.Is(err, httpproxy.ErrAuthRequired):
+		return "auth"
+	case errors.Is(err, socks5.ErrNoAcceptableMethods):
+		return "method"
+	case errors.Is(err, socks4.ErrRejected):
+		return "rejected"
+	default:
+		return "protocol"
+	}
+}
+
+// byteCounter counts bytes written to w in bytesTotal and n
+type byteCounter struct {
+	w         io.Writer
+	direction string
+	n         int64
+}
+
+func (c *byteCounter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	bytesTotal.Add(float64(n), c.direction)
+	c.n += int64(n)
+	return n, err
+}
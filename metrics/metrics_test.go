@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestScrape(t *testing.T) {
+	r := new(Registry)
+
+	requests := r.NewCounter("requests_total", "Requests.\nSecond \\ line.", "path")
+	active := r.NewGauge("active", "Active connections.")
+	duration := r.NewHistogram("duration_seconds", "Request duration.", []float64{.1, 1}, "path")
+
+	requests.Add(1, "/a")
+	requests.Add(2, "/a")
+	requests.Add(1, "say \"hi\"\\\n")
+	active.Add(3)
+	active.Add(-1)
+	duration.Observe(.05, "/a")
+	duration.Observe(.5, "/a")
+	duration.Observe(5, "/a")
+
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/plain; version=0.0.4" {
+		t.Errorf("got content type %q", ct)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# HELP requests_total Requests.\nSecond \\ line.
+# TYPE requests_total counter
+requests_total{path="/a"} 3
+requests_total{path="say \"hi\"\\\n"} 1
+# HELP active Active connections.
+# TYPE active gauge
+active 2
+# HELP duration_seconds Request duration.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{path="/a",le="0.1"} 1
+duration_seconds_bucket{path="/a",le="1"} 2
+duration_seconds_bucket{path="/a",le="+Inf"} 3
+duration_seconds_sum{path="/a"} 5.55
+duration_seconds_count{path="/a"} 3
+`
+
+	if got := string(body); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestLabelCount(t *testing.T) {
+	r := new(Registry)
+	c := r.NewCounter("c", "C.", "a", "b")
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a panic for a wrong number of label values")
+		}
+	}()
+
+	c.Add(1, "only one")
+}
+
+func TestEmptyRegistry(t *testing.T) {
+	b := strings.Builder{}
+	n, err := new(Registry).WriteTo(&b)
+	if err != nil || n != 0 || b.Len() != 0 {
+		t.Fatalf("got %d %q %v", n, b.String(), err)
+	}
+}
@@ -0,0 +1,429 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// chainList holds the entries of a ChainPicker
+type chainList struct {
+	mutex   sync.RWMutex
+	entries []*Entry
+	nextid  int
+	breaker CircuitBreaker
+	rules   []Rule
+}
+
+func (l *chainList) SetCircuitBreaker(b CircuitBreaker) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.breaker = b
+}
+
+func (l *chainList) Report(e *Entry, latency time.Duration, err error) {
+	l.mutex.RLock()
+	b := l.breaker
+	l.mutex.RUnlock()
+
+	if backoff, tripped := e.reported(latency, err, b); tripped {
+		slog.Warn("chain is out of rotation", "id", e.ID, "chain", e.Chain.String(), "backoff", backoff, "err", err)
+	}
+}
+
+func (l *chainList) Add(c Chain) *Entry {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.add(c, false)
+}
+
+// add appends c to l, loaded is true if c was read from a config. l.mutex
+// must be held
+func (l *chainList) add(c Chain, loaded bool) *Entry {
+	l.prepare(c)
+	e := &Entry{ID: l.nextid, Chain: c, loaded: loaded}
+	l.entries = append(l.entries, e)
+	l.nextid += 1
+	return e
+}
+
+func (l *chainList) Get(id int) *Entry {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	for _, e := range l.entries {
+		if e.ID == id {
+			return e
+		}
+	}
+	return nil
+}
+
+// Remove removes the entry with id. Connections already made through it
+// are left alone
+func (l *chainList) Remove(id int) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for i, e := range l.entries {
+		if e.ID != id {
+			continue
+		}
+		// entries returned by All may still be in use
+		entries := make([]*Entry, 0, len(l.entries)-1)
+		entries = append(entries, l.entries[:i]...)
+		entries = append(entries, l.entries[i+1:]...)
+		l.entries = entries
+		e.remove()
+		e.Chain.resetCache()
+		return true
+	}
+	return false
+}
+
+func (l *chainList) Disable(id int) bool {
+	e := l.Get(id)
+	if e == nil {
+		return false
+	}
+	e.setDisabled(true)
+	return true
+}
+
+func (l *chainList) Enable(id int) bool {
+	e := l.Get(id)
+	if e == nil {
+		return false
+	}
+	e.setDisabled(false)
+	return true
+}
+
+func (l *chainList) Len() int {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return len(l.entries)
+}
+
+func (l *chainList) All() []*Entry {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return l.entries
+}
+
+func (l *chainList) Load(f io.Reader) error {
+	parseMutex.Lock()
+	defer parseMutex.Unlock()
+
+	chains, rules, err := parseConfig(f)
+	if err != nil {
+		return err
+	}
+
+	all := append([]Chain{}, chains...)
+	for _, e := range l.All() {
+		all = append(all, e.Chain)
+	}
+
+	implicit, err := routeChains(all, rules)
+	if err != nil {
+		return err
+	}
+	chains = append(chains, implicit...)
+
+	if err := validateChains(chains, append(all, implicit...)); err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	for _, c := range chains {
+		l.add(c, true)
+	}
+	l.rules = append(l.rules, rules...)
+	l.mutex.Unlock()
+
+	return nil
+}
+
+// Reload replaces the chains and rules of l with the ones read from
+// readers, as if l was empty. Chains that did not change keep their entry.
+// On error l is left unchanged
+func (l *chainList) Reload(readers ...io.Reader) error {
+	parseMutex.Lock()
+	defer parseMutex.Unlock()
+
+	kwargs := globalKWArgs
+	globalKWArgs = map[string]string{}
+
+	var (
+		chains []Chain
+		rules  []Rule
+	)
+
+	for _, r := range readers {
+		c, rs, err := parseConfig(r)
+		if err != nil {
+			globalKWArgs = kwargs
+			return err
+		}
+		chains = append(chains, c...)
+		rules = append(rules, rs...)
+	}
+
+	if len(chains) == 0 {
+		globalKWArgs = kwargs
+		return errors.New("config: no chains")
+	}
+
+	implicit, err := routeChains(chains, rules)
+	if err != nil {
+		globalKWArgs = kwargs
+		return err
+	}
+	chains = append(chains, implicit...)
+
+	if err := validateChains(chains, chains); err != nil {
+		globalKWArgs = kwargs
+		return err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	old := map[string][]*Entry{}
+	for _, e := range l.entries {
+		k := e.Chain.key()
+		old[k] = append(old[k], e)
+	}
+
+	entries := make([]*Entry, 0, len(chains))
+	for _, c := range chains {
+		k := c.key()
+		if es := old[k]; len(es) != 0 {
+			// files used by the chain may have changed
+			es[0].Chain.resetCache()
+			es[0].loaded = true
+			entries = append(entries, es[0])
+			old[k] = es[1:]
+			continue
+		}
+		l.prepare(c)
+		entries = append(entries, &Entry{ID: l.nextid, Chain: c, loaded: true})
+		l.nextid += 1
+	}
+
+	var dropped []int
+	for _, es := range old {
+		for _, e := range es {
+			if !e.loaded {
+				dropped = append(dropped, e.ID)
+			}
+			e.remove()
+			e.Chain.resetCache()
+		}
+	}
+
+	l.entries = entries
+	l.rules = rules
+
+	if len(dropped) != 0 {
+		sort.Ints(dropped)
+		slog.Warn("reload removed chains added at runtime", "ids", dropped)
+	}
+
+	return nil
+}
+
+func (l *chainList) Rules() []Rule {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return l.rules
+}
+
+// Route returns the group of the first rule matching address
+func (l *chainList) Route(address string) (string, bool) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	for i := range l.rules {
+		if l.rules[i].Match(address) {
+			return l.rules[i].Group, true
+		}
+	}
+	return "", false
+}
+
+// routeChains checks that every rule routes to a group with chains. Rules
+// to `direct` or `reject` without such a group get a chain of that protocol,
+// which is returned
+func routeChains(chains []Chain, rules []Rule) ([]Chain, error) {
+	groups := map[string]bool{}
+	for _, c := range chains {
+		groups[c.Group()] = true
+	}
+
+	var implicit []Chain
+
+	for i := range rules {
+		group := rules[i].Group
+		if groups[group] {
+			continue
+		}
+		if !isPseudoProtocol(group) {
+			return nil, fmt.Errorf("config: `%s`: group %q has no chains", rules[i].String(), group)
+		}
+		implicit = append(implicit, Chain{{Protocol: group, KWArgs: map[string]string{"Group": group}, implicit: true}})
+		groups[group] = true
+	}
+
+	return implicit, nil
+}
+
+// validateChains checks that every proxy of chains can be converted to a
+// dialer and that `@group` references name a group of all
+func validateChains(chains, all []Chain) error {
+	groups := map[string]bool{}
+	for _, c := range all {
+		groups[c.Group()] = true
+	}
+
+	for _, c := range chains {
+		for _, p := range c {
+			if group, ok := p.GroupRef(); ok {
+				if !groups[group] {
+					return fmt.Errorf("config: `%s`: group %q has no chains", c.String(), group)
+				}
+				continue
+			}
+			if _, err := p.ToDialer(); err != nil {
+				return fmt.Errorf("config: `%s`: %w", c.String(), err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// prepare sets what c needs to be dialed as part of l
+func (l *chainList) prepare(c Chain) {
+	for i := range c {
+		c[i].lookup = l.member
+		c[i].cache = new(dialerCache)
+	}
+}
+
+// inPool reports whether c is picked from group if grouped is true, or
+// from the chains without a group otherwise
+func (c Chain) inPool(group string, grouped bool) bool {
+	if grouped {
+		return c.Group() == group
+	}
+	return len(c.Group()) == 0
+}
+
+// Implicit reports whether c was added for a routing rule instead of read
+// from the config
+func (c Chain) Implicit() bool {
+	return len(c) == 1 && c[0].implicit
+}
+
+// Rejects reports whether c is a `reject` chain, which never connects
+func (c Chain) Rejects() bool {
+	return len(c) == 1 && c[0].Protocol == "reject"
+}
+
+// isPseudo reports whether c is a `direct` or `reject` chain
+func (c Chain) isPseudo() bool {
+	return len(c) == 1 && isPseudoProtocol(c[0].Protocol)
+}
+
+func (c Chain) resetCache() {
+	for _, p := range c {
+		p.cache.reset()
+	}
+}
+
+// member returns a random available chain of group, used to resolve
+// `@group` references
+func (l *chainList) member(group string) (Chain, error) {
+	l.mutex.RLock()
+	entries := l.available(group, true)
+	l.mutex.RUnlock()
+
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("group %q has no available chains", group)
+	}
+
+	memberRandMutex.Lock()
+	i := memberRand.Intn(len(entries))
+	memberRandMutex.Unlock()
+
+	return entries[i].Chain, nil
+}
+
+var (
+	memberRand      = rand.New(rand.NewSource(time.Now().UnixNano()))
+	memberRandMutex sync.Mutex
+)
+
+func (l *chainList) Connected(e *Entry) {
+	e.connected(1)
+}
+
+func (l *chainList) Disconnected(e *Entry) {
+	e.connected(-1)
+}
+
+// available returns the available entries of group if grouped is true,
+// otherwise the ones without a group. l.mutex must be held
+func (l *chainList) available(group string, grouped bool) []*Entry {
+	return pool(l.entries, group, grouped, nil)
+}
+
+// pool returns the available entries of group if grouped is true, otherwise
+// the ones without a group, leaving out exclude. `direct` and `reject`
+// chains without a group are only returned if no other chain is available
+func pool(all []*Entry, group string, grouped bool, exclude []*Entry) []*Entry {
+	var (
+		entries  = make([]*Entry, 0, len(all))
+		fallback []*Entry
+	)
+
+	for _, e := range all {
+		if !e.Chain.inPool(group, grouped) || !e.Available() || hasEntry(exclude, e) {
+			continue
+		}
+		if !grouped && e.Chain.isPseudo() {
+			fallback = append(fallback, e)
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	if len(entries) == 0 {
+		return fallback
+	}
+
+	return entries
+}
+
+// key identifies c across reloads
+func (c Chain) key() string {
+	b := strings.Builder{}
+	for _, p := range c {
+		fmt.Fprintf(&b, "%q %q %q %t", p.Protocol, p.Address, p.Args, p.implicit)
+		keys := make([]string, 0, len(p.KWArgs))
+		for k := range p.KWArgs {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(&b, " %q=%q", k, p.KWArgs[k])
+		}
+		b.WriteString(" | ")
+	}
+	return b.String()
+}
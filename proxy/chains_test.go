@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+)
+
+const groupsConfig = `
+socks5 127.0.0.1:1080
+group residential {
+socks5 127.0.0.2:1080
+socks5 127.0.0.3:1080
+}
+set Group datacenter | socks5 127.0.0.4:1080
+socks5 127.0.0.5:1080 | @residential
+`
+
+func TestGroupsPool(t *testing.T) {
+	pickers := map[string]ChainPicker{
+		"roundrobin": new(RoundRobin),
+		"random":     new(Random),
+		"weighted":   new(Weighted),
+		"leastconn":  new(LeastConn),
+		"latency":    new(LowestLatency),
+	}
+
+	for name, picker := range pickers {
+		t.Run(name, func(t *testing.T) {
+			if err := picker.Load(strings.NewReader(groupsConfig)); err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < 10; i++ {
+				e := picker.Next()
+				if e == nil {
+					t.Fatal("Next returned nil")
+				}
+				if group := e.Chain.Group(); len(group) != 0 {
+					t.Fatalf("Next returned %s of group %q", e.Chain, group)
+				}
+
+				e = picker.NextGroup("residential")
+				if e == nil {
+					t.Fatal("NextGroup returned nil")
+				}
+				if group := e.Chain.Group(); group != "residential" {
+					t.Fatalf("NextGroup returned %s of group %q", e.Chain, group)
+				}
+			}
+
+			if e := picker.NextGroup("datacenter"); e == nil || e.Chain.String() != "socks5 127.0.0.4:1080" {
+				t.Fatalf("NextGroup(datacenter) returned %v", e)
+			}
+		})
+	}
+}
+
+func TestGroupRef(t *testing.T) {
+	picker := new(RoundRobin)
+	if err := picker.Load(strings.NewReader(groupsConfig)); err != nil {
+		t.Fatal(err)
+	}
+
+	var ref *Entry
+	for _, e := range picker.All() {
+		if _, ok := e.Chain[len(e.Chain)-1].GroupRef(); ok {
+			ref = e
+		}
+	}
+	if ref == nil {
+		t.Fatal("no chain with a group reference")
+	}
+
+	for i := 0; i < 10; i++ {
+		d, err := ref.Chain.ToDialer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := d.String()
+		if got != "socks5 127.0.0.5:1080 | socks5 127.0.0.2:1080" && got != "socks5 127.0.0.5:1080 | socks5 127.0.0.3:1080" {
+			t.Fatalf("got dialer %s", got)
+		}
+	}
+}
+
+func TestPseudoFallback(t *testing.T) {
+	picker := new(RoundRobin)
+	config := "socks5 127.0.0.1:1080\nreject\nset Group blocked | reject\n"
+	if err := picker.Load(strings.NewReader(config)); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 4; i++ {
+		if e := picker.Next(); e == nil || e.ID != 0 {
+			t.Fatalf("Next returned %v, want the socks5 chain", e)
+		}
+	}
+
+	if e := picker.NextGroup("blocked"); e == nil || e.ID != 2 {
+		t.Fatalf("NextGroup(blocked) returned %v", e)
+	}
+
+	picker.Disable(0)
+
+	if e := picker.Next(); e == nil || e.ID != 1 {
+		t.Fatalf("Next returned %v, want the reject fallback", e)
+	}
+}
+
+func TestReloadInvalid(t *testing.T) {
+	configs := []string{
+		"sock5 127.0.0.1:1080\n",
+		"socks5 127.0.0.1:1080 | @missing\n",
+		"socks5 127.0.0.1:1080\nroute default missing\n",
+	}
+
+	for _, config := range configs {
+		picker := new(RoundRobin)
+		if err := picker.Reload(strings.NewReader("socks5 127.0.0.1:1081\n")); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := picker.Reload(strings.NewReader(config)); err == nil {
+			t.Fatalf("%q: expected an error", config)
+		}
+
+		if e := picker.Next(); e == nil || e.Chain.String() != "socks5 127.0.0.1:1081" {
+			t.Fatalf("%q: old chains were replaced, Next returned %v", config, e)
+		}
+	}
+}
@@ -5,14 +5,79 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	nethttp "net/http"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/sloweax/socksx/proxy/http"
+	"github.com/sloweax/socksx/proxy/socks5"
+	gossh "golang.org/x/crypto/ssh"
 )
 
+// ErrUDPMultiHop is returned by ListenPacket for chains of more than one
+// proxy, as datagrams would bypass every proxy but the last
+var ErrUDPMultiHop = errors.New("udp through more than one proxy exposes this host to the last proxy, set UnsafeUDP true to allow it")
+
+// TargetError is returned when the chain works but its last proxy could
+// not reach the target, such as a refused connection
+type TargetError struct {
+	Err error
+}
+
+func (e *TargetError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TargetError) Unwrap() error {
+	return e.Err
+}
+
+// targetError wraps err of the last proxy of a chain in a TargetError if it
+// is clearly about the target. Failures that may come from the proxy itself,
+// such as its own rules or authentication, are left to the breaker
+func targetError(err error) error {
+	var (
+		reply   *socks5.ReplyError
+		connect *http.ConnectError
+		channel *gossh.OpenChannelError
+		dns     *net.DNSError
+	)
+
+	switch {
+	case errors.As(err, &reply):
+		switch reply.Reply {
+		case socks5.ReplyNetworkUnreachable, socks5.ReplyHostUnreachable, socks5.ReplyConnRefused, socks5.ReplyTTLExpired:
+		default:
+			return err
+		}
+	case errors.As(err, &connect):
+		switch connect.StatusCode {
+		case nethttp.StatusBadGateway, nethttp.StatusGatewayTimeout:
+		default:
+			return err
+		}
+	case errors.As(err, &channel) && channel.Reason == gossh.ConnectionFailed:
+	case errors.As(err, &dns) && dns.IsNotFound:
+	default:
+		return err
+	}
+
+	return &TargetError{Err: err}
+}
+
 type Dialer struct {
 	proxies []ProxyDialer
 }
 
+// sharedDialer is implemented by dialers that keep their connection to the
+// proxy open, so it can be used without dialing the previous proxies
+type sharedDialer interface {
+	// DialShared connects to address through the open connection, ok is
+	// false if there is none
+	DialShared(ctx context.Context, network, address string) (conn net.Conn, ok bool, err error)
+}
+
 func New(proxies ...ProxyDialer) *Dialer {
 	d := new(Dialer)
 	d.proxies = proxies
@@ -22,6 +87,10 @@ func New(proxies ...ProxyDialer) *Dialer {
 func (d *Dialer) String() string {
 	a := make([]string, 0, len(d.proxies))
 	for _, p := range d.proxies {
+		if len(p.String()) == 0 {
+			a = append(a, p.Protocol())
+			continue
+		}
 		a = append(a, fmt.Sprintf("%s %s", p.Protocol(), p.String()))
 	}
 	return strings.Join(a, " | ")
@@ -39,13 +108,33 @@ func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.
 	}
 	defer cancel()
 
-	dialer := net.Dialer{}
-	conn, err := dialer.DialContext(entryctx, p.Network(), p.String())
+	if pd, ok := p.(pseudoDialer); ok {
+		conn, err := pd.DialContext(entryctx, network, address)
+		if err != nil {
+			// there is no proxy to fail, only the target
+			return nil, &TargetError{Err: fmt.Errorf("%s: %w", p.Protocol(), err)}
+		}
+		if err := setTimeouts(conn, p); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s: %w", p.Protocol(), err)
+		}
+		return conn, nil
+	}
+
+	conn, start, err := d.dialShared(ctx, network, address)
 	if err != nil {
-		return nil, fmt.Errorf("%s %s: %w", p.Protocol(), p.String(), err)
+		return nil, err
+	}
+
+	if conn == nil {
+		dialer := net.Dialer{}
+		conn, err = dialer.DialContext(entryctx, p.Network(), p.String())
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %w", p.Protocol(), p.String(), err)
+		}
 	}
 
-	for i := 0; i < len(d.proxies); i++ {
+	for i := start; i < len(d.proxies); i++ {
 		p := d.proxies[i]
 
 		var (
@@ -78,31 +167,198 @@ func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.
 		pconn, err := p.DialContextWithConn(pctx, conn, pnetwork, paddress)
 		if err != nil {
 			conn.Close()
-			return nil, fmt.Errorf("%s %s: %w", p.Protocol(), p.String(), err)
+			err = fmt.Errorf("%s %s: %w", p.Protocol(), p.String(), err)
+			if i == len(d.proxies)-1 {
+				err = targetError(err)
+			}
+			return nil, err
 		}
 		conn = pconn
 	}
 
 	p = d.proxies[len(d.proxies)-1]
-	wtimeout, ok := p.KWArgs()["WriteTimeout"]
-	if ok {
-		err = setTimeoutStr(conn, wtimeout, conn.SetWriteDeadline)
+	if err := setTimeouts(conn, p); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%s %s: %w", p.Protocol(), p.String(), err)
+	}
+
+	return conn, nil
+}
+
+// ListenPacket requests a UDP association from the last proxy of the chain.
+// Only the control connection goes through the previous proxies
+func (d *Dialer) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	if len(d.proxies) == 0 {
+		return nil, errors.New("no dialers")
+	}
+
+	p := d.proxies[len(d.proxies)-1]
+
+	if pd, ok := p.(pseudoDialer); ok {
+		pconn, err := pd.ListenPacket(ctx)
 		if err != nil {
-			conn.Close()
-			return nil, fmt.Errorf("%s %s: %w", p.Protocol(), p.String(), err)
+			return nil, fmt.Errorf("%s: %w", p.Protocol(), err)
+		}
+		return pconn, nil
+	}
+
+	pd, ok := p.(PacketDialer)
+	if !ok {
+		return nil, fmt.Errorf("%s %s: udp is not supported", p.Protocol(), p.String())
+	}
+
+	if len(d.proxies) > 1 {
+		unsafe, _ := strconv.ParseBool(p.KWArgs()["UnsafeUDP"])
+		if !unsafe {
+			return nil, ErrUDPMultiHop
+		}
+	}
+
+	conn, pctx, pcancel, err := d.dialLast(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer pcancel()
+
+	pconn, err := pd.ListenPacketWithConn(pctx, conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%s %s: %w", p.Protocol(), p.String(), err)
+	}
+
+	return pconn, nil
+}
+
+// Listen sends a BIND request for address to the last proxy of the chain
+func (d *Dialer) Listen(ctx context.Context, address string) (net.Listener, error) {
+	if len(d.proxies) == 0 {
+		return nil, errors.New("no dialers")
+	}
+
+	p := d.proxies[len(d.proxies)-1]
+
+	if pd, ok := p.(pseudoDialer); ok {
+		l, err := pd.Listen(ctx, address)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p.Protocol(), err)
 		}
+		return l, nil
+	}
+
+	bd, ok := p.(BindDialer)
+	if !ok {
+		return nil, fmt.Errorf("%s %s: bind is not supported", p.Protocol(), p.String())
+	}
+
+	conn, pctx, pcancel, err := d.dialLast(ctx)
+	if err != nil {
+		return nil, err
 	}
+	defer pcancel()
 
-	rtimeout, ok := p.KWArgs()["ReadTimeout"]
-	if ok {
-		err = setTimeoutStr(conn, rtimeout, conn.SetReadDeadline)
+	l, err := bd.BindWithConn(pctx, conn, address)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%s %s: %w", p.Protocol(), p.String(), err)
+	}
+
+	return l, nil
+}
+
+// dialShared connects through the last proxy of the chain with an open
+// connection, to the proxy after it or to address. Returns the index of the
+// next proxy to dial through, conn is nil if no proxy has an open
+// connection
+func (d *Dialer) dialShared(ctx context.Context, network, address string) (net.Conn, int, error) {
+	for i := len(d.proxies) - 1; i >= 0; i-- {
+		p := d.proxies[i]
+
+		sd, ok := p.(sharedDialer)
+		if !ok {
+			continue
+		}
+
+		pnetwork, paddress := network, address
+		if i != len(d.proxies)-1 {
+			pnetwork = d.proxies[i+1].Network()
+			paddress = d.proxies[i+1].String()
+		}
+
+		pctx, pcancel, err := proxyCtx(p, ctx)
 		if err != nil {
-			conn.Close()
-			return nil, fmt.Errorf("%s %s: %w", p.Protocol(), p.String(), err)
+			return nil, 0, fmt.Errorf("%s %s: %w", p.Protocol(), p.String(), err)
+		}
+
+		conn, ok, err := sd.DialShared(pctx, pnetwork, paddress)
+		pcancel()
+		if err != nil {
+			err = fmt.Errorf("%s %s: %w", p.Protocol(), p.String(), err)
+			if i == len(d.proxies)-1 {
+				err = targetError(err)
+			}
+			return nil, 0, err
+		}
+		if ok {
+			return conn, i + 1, nil
 		}
 	}
 
-	return conn, nil
+	return nil, 0, nil
+}
+
+// dialLast connects to the last proxy of the chain and returns the context
+// for its handshake
+func (d *Dialer) dialLast(ctx context.Context) (net.Conn, context.Context, context.CancelFunc, error) {
+	var (
+		conn net.Conn
+		err  error
+	)
+
+	p := d.proxies[len(d.proxies)-1]
+
+	if len(d.proxies) == 1 {
+		entryctx, cancel, err := proxyCtx(p, ctx)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("%s %s: %w", p.Protocol(), p.String(), err)
+		}
+		defer cancel()
+
+		dialer := net.Dialer{}
+		conn, err = dialer.DialContext(entryctx, p.Network(), p.String())
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("%s %s: %w", p.Protocol(), p.String(), err)
+		}
+	} else {
+		conn, err = New(d.proxies[:len(d.proxies)-1]...).DialContext(ctx, p.Network(), p.String())
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	pctx, pcancel, err := proxyCtx(p, ctx)
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, fmt.Errorf("%s %s: %w", p.Protocol(), p.String(), err)
+	}
+
+	return conn, pctx, pcancel, nil
+}
+
+// setTimeouts applies the ReadTimeout and WriteTimeout kwargs of p to conn
+func setTimeouts(conn net.Conn, p ProxyDialer) error {
+	if wtimeout, ok := p.KWArgs()["WriteTimeout"]; ok {
+		if err := setTimeoutStr(conn, wtimeout, conn.SetWriteDeadline); err != nil {
+			return err
+		}
+	}
+
+	if rtimeout, ok := p.KWArgs()["ReadTimeout"]; ok {
+		if err := setTimeoutStr(conn, rtimeout, conn.SetReadDeadline); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func setTimeoutStr(conn net.Conn, s string, fc func(time.Time) error) error {
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	nethttp "net/http"
+	"testing"
+
+	"github.com/sloweax/socksx/proxy/http"
+	"github.com/sloweax/socksx/proxy/socks4"
+	"github.com/sloweax/socksx/proxy/socks5"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestTargetError(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		target bool
+	}{
+		{"socks5 network unreachable", socks5.ReplyNetworkUnreachable.Err(), true},
+		{"socks5 host unreachable", socks5.ReplyHostUnreachable.Err(), true},
+		{"socks5 connection refused", socks5.ReplyConnRefused.Err(), true},
+		{"socks5 ttl expired", socks5.ReplyTTLExpired.Err(), true},
+		{"socks5 general failure", socks5.ReplyGeneralFailure.Err(), false},
+		{"socks5 not allowed", socks5.ReplyConnNotAllowed.Err(), false},
+		{"socks5 command not supported", socks5.ReplyCmdNotSupported.Err(), false},
+		{"socks5 address type not supported", socks5.ReplyAtypNotSupported.Err(), false},
+		{"socks4 rejected", socks4.ErrRejected, false},
+		{"socks4 ident unreachable", socks4.ErrIdentUnreachable, false},
+		{"socks4 ident mismatch", socks4.ErrIdentMismatch, false},
+		{"http 502", &http.ConnectError{StatusCode: nethttp.StatusBadGateway}, true},
+		{"http 504", &http.ConnectError{StatusCode: nethttp.StatusGatewayTimeout}, true},
+		{"http 403", &http.ConnectError{StatusCode: nethttp.StatusForbidden}, false},
+		{"http 407", &http.ConnectError{StatusCode: nethttp.StatusProxyAuthRequired}, false},
+		{"http 503", &http.ConnectError{StatusCode: nethttp.StatusServiceUnavailable}, false},
+		{"ssh connection failed", &gossh.OpenChannelError{Reason: gossh.ConnectionFailed}, true},
+		{"ssh prohibited", &gossh.OpenChannelError{Reason: gossh.Prohibited}, false},
+		{"nxdomain", &net.DNSError{Err: "no such host", IsNotFound: true}, true},
+		{"dns timeout", &net.DNSError{Err: "timeout", IsTimeout: true}, false},
+		{"eof", io.EOF, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := targetError(fmt.Errorf("socks5 127.0.0.1:1080: %w", tt.err))
+
+			var terr *TargetError
+			if got := errors.As(err, &terr); got != tt.target {
+				t.Fatalf("got target error %v, want %v", got, tt.target)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("%v does not wrap %v", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+var ErrRejected = errors.New("connection rejected by config")
+
+// pseudoDialer is implemented by `direct` and `reject`, which handle
+// requests themselves instead of through a connection to a proxy. They must
+// be the only proxy of a chain
+type pseudoDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+	ListenPacket(ctx context.Context) (net.PacketConn, error)
+	Listen(ctx context.Context, address string) (net.Listener, error)
+}
+
+func isPseudoProtocol(protocol string) bool {
+	switch protocol {
+	case "direct", "reject":
+		return true
+	default:
+		return false
+	}
+}
+
+// directDialer connects to targets without a proxy, from the ip set with
+// the SourceAddress kwarg if any
+type directDialer struct {
+	kwargs map[string]string
+	source net.IP
+}
+
+func (p *ProxyInfo) ToDirect() (ProxyDialer, error) {
+	if len(p.Address) != 0 || len(p.Args) != 0 {
+		return nil, fmt.Errorf("%s: invalid proxy options", p.Protocol)
+	}
+
+	d := &directDialer{kwargs: p.KWArgs}
+
+	if s, ok := p.KWArgs["SourceAddress"]; ok {
+		d.source = net.ParseIP(s)
+		if d.source == nil {
+			return nil, fmt.Errorf("%s: invalid SourceAddress `%s`", p.Protocol, s)
+		}
+	}
+
+	return d, nil
+}
+
+func (d *directDialer) Protocol() string {
+	return "direct"
+}
+
+func (d *directDialer) String() string {
+	return ""
+}
+
+func (d *directDialer) Network() string {
+	return "tcp"
+}
+
+func (d *directDialer) KWArgs() map[string]string {
+	return d.kwargs
+}
+
+func (d *directDialer) DialContextWithConn(ctx context.Context, conn net.Conn, network, address string) (net.Conn, error) {
+	return nil, errors.New("direct must be the only proxy of a chain")
+}
+
+func (d *directDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := net.Dialer{}
+	if d.source != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: d.source}
+	}
+	return dialer.DialContext(ctx, network, address)
+}
+
+func (d *directDialer) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	lc := net.ListenConfig{}
+	pconn, err := lc.ListenPacket(ctx, "udp", d.localAddress())
+	if err != nil {
+		return nil, err
+	}
+	return &directPacketConn{PacketConn: pconn}, nil
+}
+
+func (d *directDialer) Listen(ctx context.Context, address string) (net.Listener, error) {
+	lc := net.ListenConfig{}
+	return lc.Listen(ctx, "tcp", d.localAddress())
+}
+
+func (d *directDialer) localAddress() string {
+	if d.source == nil {
+		return ":0"
+	}
+	return net.JoinHostPort(d.source.String(), "0")
+}
+
+// directPacketConn resolves the hostnames of addresses it sends to
+type directPacketConn struct {
+	net.PacketConn
+}
+
+func (c *directPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if _, ok := addr.(*net.UDPAddr); !ok {
+		udpaddr, err := net.ResolveUDPAddr("udp", addr.String())
+		if err != nil {
+			return 0, err
+		}
+		addr = udpaddr
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+// rejectDialer fails every request with ErrRejected
+type rejectDialer struct {
+	kwargs map[string]string
+}
+
+func (p *ProxyInfo) ToReject() (ProxyDialer, error) {
+	if len(p.Address) != 0 || len(p.Args) != 0 {
+		return nil, fmt.Errorf("%s: invalid proxy options", p.Protocol)
+	}
+	return &rejectDialer{kwargs: p.KWArgs}, nil
+}
+
+func (d *rejectDialer) Protocol() string {
+	return "reject"
+}
+
+func (d *rejectDialer) String() string {
+	return ""
+}
+
+func (d *rejectDialer) Network() string {
+	return "tcp"
+}
+
+func (d *rejectDialer) KWArgs() map[string]string {
+	return d.kwargs
+}
+
+func (d *rejectDialer) DialContextWithConn(ctx context.Context, conn net.Conn, network, address string) (net.Conn, error) {
+	return nil, ErrRejected
+}
+
+func (d *rejectDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return nil, ErrRejected
+}
+
+func (d *rejectDialer) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	return nil, ErrRejected
+}
+
+func (d *rejectDialer) Listen(ctx context.Context, address string) (net.Listener, error) {
+	return nil, ErrRejected
+}
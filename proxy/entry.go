@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// CircuitBreaker takes a chain out of rotation after Threshold consecutive
+// failures. It stays out for Backoff, doubled every time the chain fails
+// again right after coming back, up to MaxBackoff
+type CircuitBreaker struct {
+	// 0 disables the circuit breaker
+	Threshold  int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// Entry is a chain held by a ChainPicker and its state
+type Entry struct {
+	ID    int
+	Chain Chain
+
+	mutex sync.Mutex
+	// set by health checks
+	down      bool
+	fails     int
+	successes int
+	// set by reported failures
+	failures  int
+	trips     int
+	halfopen  bool
+	openuntil time.Time
+	// connection stats
+	active  int
+	latency time.Duration
+	dials   int
+	errors  int
+	// set when the entry is no longer held by its ChainPicker
+	removed bool
+	// set for chains read from a config, not added with ChainPicker.Add
+	loaded bool
+	// set by ChainPicker.Disable
+	disabled bool
+}
+
+// EntryStats is a snapshot of the state of an Entry
+type EntryStats struct {
+	Down     bool
+	Disabled bool
+	// the circuit breaker took the entry out of rotation
+	Open    bool
+	Active  int
+	Latency time.Duration
+	Dials   int
+	Errors  int
+}
+
+const (
+	// weight of new latency samples
+	latencyAlpha = 0.3
+	// latency sample recorded for failed dials
+	latencyPenalty = 5 * time.Second
+)
+
+// Active returns the number of open connections through the entry
+func (e *Entry) Active() int {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.active
+}
+
+// Latency returns the moving average of dial durations, 0 if unknown
+func (e *Entry) Latency() time.Duration {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.latency
+}
+
+func (e *Entry) connected(delta int) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.active += delta
+}
+
+func (e *Entry) Available() bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return !e.down && !e.removed && !e.disabled && !time.Now().Before(e.openuntil)
+}
+
+func (e *Entry) Stats() EntryStats {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return EntryStats{
+		Down:     e.down,
+		Disabled: e.disabled,
+		Open:     time.Now().Before(e.openuntil),
+		Active:   e.active,
+		Latency:  e.latency,
+		Dials:    e.dials,
+		Errors:   e.errors,
+	}
+}
+
+func (e *Entry) remove() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.removed = true
+}
+
+func (e *Entry) setDisabled(disabled bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.disabled = disabled
+}
+
+func (e *Entry) Down() bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.down
+}
+
+// checked records a health check result. The entry goes down after fall
+// consecutive failures and up after rise consecutive successes. Returns
+// whether the state changed
+func (e *Entry) checked(err error, fall, rise int) bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if err != nil {
+		e.successes = 0
+		e.fails += 1
+		if !e.down && e.fails >= fall {
+			e.down = true
+			return true
+		}
+		return false
+	}
+
+	e.fails = 0
+	e.successes += 1
+	if e.down && e.successes >= rise {
+		e.down = false
+		return true
+	}
+	return false
+}
+
+// reported records the result of a dial through the entry. Returns
+// how long the entry is out of rotation if the circuit breaker tripped
+func (e *Entry) reported(latency time.Duration, err error, b CircuitBreaker) (time.Duration, bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.dials += 1
+	if err != nil {
+		e.errors += 1
+	}
+
+	if err != nil && latency < latencyPenalty {
+		latency = latencyPenalty
+	}
+
+	if e.latency == 0 {
+		e.latency = latency
+	} else {
+		e.latency = time.Duration(latencyAlpha*float64(latency) + (1-latencyAlpha)*float64(e.latency))
+	}
+
+	if err == nil {
+		e.failures = 0
+		e.trips = 0
+		e.halfopen = false
+		return 0, false
+	}
+
+	if b.Threshold <= 0 {
+		return 0, false
+	}
+
+	e.failures += 1
+	if !e.halfopen && e.failures < b.Threshold {
+		return 0, false
+	}
+
+	backoff := b.Backoff
+	for i := 0; i < e.trips && backoff < b.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > b.MaxBackoff {
+		backoff = b.MaxBackoff
+	}
+
+	e.trips += 1
+	e.failures = 0
+	e.halfopen = true
+	e.openuntil = time.Now().Add(backoff)
+
+	return backoff, true
+}
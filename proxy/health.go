@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// HealthCheck periodically dials Target through every chain of Picker.
+// Chains that fail Fall times in a row are marked down and skipped by the
+// picker until they succeed Rise times in a row. At most Workers chains are
+// checked at the same time
+type HealthCheck struct {
+	Picker   ChainPicker
+	Target   string
+	Interval time.Duration
+	Timeout  time.Duration
+	Fall     int
+	Rise     int
+	Workers  int
+}
+
+func (h *HealthCheck) Run(ctx context.Context) {
+	ticker := time.NewTicker(h.Interval)
+	defer ticker.Stop()
+
+	for {
+		h.CheckAll(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h *HealthCheck) CheckAll(ctx context.Context) {
+	h.CheckEntries(ctx, h.Picker.All(), func(e *Entry, _ time.Duration, err error) {
+		if e.checked(err, h.Fall, h.Rise) {
+			if err != nil {
+				slog.Warn("chain is down", "id", e.ID, "chain", e.Chain.String(), "err", err)
+			} else {
+				slog.Info("chain is up", "id", e.ID, "chain", e.Chain.String())
+			}
+		}
+	})
+}
+
+// CheckEntries checks entries with at most h.Workers at a time and calls fn
+// with the result of each, from multiple goroutines. Returns once every
+// entry is checked
+func (h *HealthCheck) CheckEntries(ctx context.Context, entries []*Entry, fn func(e *Entry, latency time.Duration, err error)) {
+	workers := h.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	jobs := make(chan *Entry)
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < workers && i < len(entries); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range jobs {
+				start := time.Now()
+				err := h.Check(ctx, e)
+				fn(e, time.Since(start), err)
+			}
+		}()
+	}
+
+	for _, e := range entries {
+		jobs <- e
+	}
+	close(jobs)
+
+	wg.Wait()
+}
+
+func (h *HealthCheck) Check(ctx context.Context, e *Entry) error {
+	d, err := e.Chain.ToDialer()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, h.Timeout)
+	defer cancel()
+
+	conn, err := d.DialContext(ctx, "tcp", h.Target)
+	if errors.Is(err, ErrRejected) {
+		// reject chains are never down
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
@@ -0,0 +1,58 @@
+package http
+
+import (
+	"bufio"
+	"net"
+	"time"
+)
+
+type Addr struct {
+	address string
+}
+
+func (a *Addr) Network() string {
+	return "tcp"
+}
+
+func (a *Addr) String() string {
+	return a.address
+}
+
+type Conn struct {
+	remote Addr
+	conn   net.Conn
+	// may hold data sent by the target right after the CONNECT response
+	r *bufio.Reader
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	return c.conn.Write(b)
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return &c.remote
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
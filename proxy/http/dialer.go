@@ -0,0 +1,129 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	nethttp "net/http"
+	"strings"
+)
+
+type Config struct {
+	Username string
+	Password string
+}
+
+// ConnectError is a CONNECT request answered with a non 2xx status
+type ConnectError struct {
+	StatusCode int
+	Status     string
+	Proto      string
+}
+
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("CONNECT failed: %s %s", e.Proto, e.Status)
+}
+
+type Dialer struct {
+	address string
+	network string
+	config  Config
+	kwargs  map[string]string
+}
+
+func NewDialer(network, address string, kwargs map[string]string, config Config) *Dialer {
+	d := new(Dialer)
+	d.network = network
+	d.address = address
+	d.config = config
+	d.kwargs = kwargs
+	return d
+}
+
+func (d *Dialer) KWArgs() map[string]string {
+	return d.kwargs
+}
+
+func (d *Dialer) Protocol() string {
+	return "http"
+}
+
+func (d *Dialer) String() string {
+	return d.address
+}
+
+func (d *Dialer) Network() string {
+	return d.network
+}
+
+func (d *Dialer) request(w io.Writer, address string) error {
+	buf := strings.Builder{}
+	buf.WriteString(fmt.Sprintf("CONNECT %s HTTP/1.1\r\n", address))
+	buf.WriteString(fmt.Sprintf("Host: %s\r\n", address))
+	if len(d.config.Username) != 0 || len(d.config.Password) != 0 {
+		credentials := base64.StdEncoding.EncodeToString([]byte(d.config.Username + ":" + d.config.Password))
+		buf.WriteString(fmt.Sprintf("Proxy-Authorization: Basic %s\r\n", credentials))
+	}
+	buf.WriteString("\r\n")
+	_, err := io.WriteString(w, buf.String())
+	return err
+}
+
+func (d *Dialer) response(r *bufio.Reader) error {
+	resp, err := nethttp.ReadResponse(r, &nethttp.Request{Method: nethttp.MethodConnect})
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return &ConnectError{StatusCode: resp.StatusCode, Status: resp.Status, Proto: resp.Proto}
+	}
+
+	return nil
+}
+
+func (d *Dialer) DialContextWithConn(ctx context.Context, conn net.Conn, network, address string) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, errors.New("tcp only")
+	}
+
+	type result struct {
+		err  error
+		conn net.Conn
+	}
+
+	cresult := make(chan result, 1)
+
+	go func() {
+		defer close(cresult)
+		if err := d.request(conn, address); err != nil {
+			cresult <- result{err: err}
+			return
+		}
+
+		r := bufio.NewReader(conn)
+		if err := d.response(r); err != nil {
+			cresult <- result{err: err}
+			return
+		}
+
+		c := new(Conn)
+		c.remote = Addr{address: address}
+		c.conn = conn
+		c.r = r
+		cresult <- result{conn: c}
+	}()
+
+	select {
+	case <-ctx.Done():
+		conn.Close()
+		return nil, ctx.Err()
+	case result := <-cresult:
+		return result.conn, result.err
+	}
+}
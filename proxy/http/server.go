@@ -0,0 +1,124 @@
+package http
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	nethttp "net/http"
+	"strings"
+)
+
+type Authenticator interface {
+	Authenticate(username, password string) bool
+}
+
+var (
+	ErrAuthFailed   = errors.New("authentication failed")
+	ErrAuthRequired = errors.New("authentication required")
+)
+
+type Server struct {
+	// if set, clients must authenticate with Proxy-Authorization basic auth
+	Auth Authenticator
+}
+
+type Request struct {
+	// target address (host:port)
+	Addr     string
+	Username string
+	// nil for CONNECT requests, otherwise the request that must be
+	// forwarded to Addr
+	Request *nethttp.Request
+}
+
+// Handle reads the client request from r. CONNECT requests are not replied,
+// see Reply
+func (s *Server) Handle(conn net.Conn, r *bufio.Reader) (Request, error) {
+	req := Request{}
+
+	hreq, err := nethttp.ReadRequest(r)
+	if err != nil {
+		return req, err
+	}
+
+	if s.Auth != nil {
+		username, password, ok := proxyBasicAuth(hreq)
+		if !ok || !s.Auth.Authenticate(username, password) {
+			s.reply(conn, nethttp.StatusProxyAuthRequired, nethttp.Header{
+				"Proxy-Authenticate": {`Basic realm="socksx"`},
+			})
+			if ok {
+				return req, fmt.Errorf("%w for user %q", ErrAuthFailed, username)
+			}
+			return req, ErrAuthRequired
+		}
+		req.Username = username
+	}
+
+	if hreq.Method == nethttp.MethodConnect {
+		if _, _, err := net.SplitHostPort(hreq.Host); err != nil {
+			s.Reply(conn, nethttp.StatusBadRequest)
+			return req, err
+		}
+		req.Addr = hreq.Host
+		return req, nil
+	}
+
+	if hreq.URL.Scheme != "http" || len(hreq.URL.Host) == 0 {
+		s.Reply(conn, nethttp.StatusBadRequest)
+		return req, fmt.Errorf("unsupported request uri `%s`", hreq.RequestURI)
+	}
+
+	req.Addr = hreq.URL.Host
+	if _, _, err := net.SplitHostPort(req.Addr); err != nil {
+		req.Addr = net.JoinHostPort(hreq.URL.Hostname(), "80")
+	}
+
+	for _, h := range []string{"Proxy-Authorization", "Proxy-Connection", "Keep-Alive"} {
+		hreq.Header.Del(h)
+	}
+	// following requests on this connection could go to another host
+	hreq.Close = true
+
+	req.Request = hreq
+
+	return req, nil
+}
+
+func (s *Server) Reply(w io.Writer, code int) error {
+	return s.reply(w, code, nil)
+}
+
+func (s *Server) reply(w io.Writer, code int, header nethttp.Header) error {
+	buf := strings.Builder{}
+	buf.WriteString(fmt.Sprintf("HTTP/1.1 %d %s\r\n", code, nethttp.StatusText(code)))
+	for k, vs := range header {
+		for _, v := range vs {
+			buf.WriteString(fmt.Sprintf("%s: %s\r\n", k, v))
+		}
+	}
+	if code != nethttp.StatusOK {
+		buf.WriteString("Content-Length: 0\r\nConnection: close\r\n")
+	}
+	buf.WriteString("\r\n")
+	_, err := io.WriteString(w, buf.String())
+	return err
+}
+
+func proxyBasicAuth(r *nethttp.Request) (string, string, bool) {
+	auth := r.Header.Get("Proxy-Authorization")
+	scheme, encoded, ok := strings.Cut(auth, " ")
+	if !ok || !strings.EqualFold(scheme, "basic") {
+		return "", "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", "", false
+	}
+
+	return strings.Cut(string(decoded), ":")
+}
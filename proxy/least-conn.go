@@ -0,0 +1,39 @@
+package proxy
+
+// LeastConn picks the chain with the fewest open connections
+type LeastConn struct {
+	chainList
+	index int
+}
+
+func (l *LeastConn) Next() *Entry {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.pick(l.available("", false))
+}
+
+func (l *LeastConn) NextGroup(group string) *Entry {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.pick(l.available(group, true))
+}
+
+func (l *LeastConn) pick(entries []*Entry) *Entry {
+	var (
+		best   *Entry
+		active int
+	)
+
+	// ties are broken in round robin order
+	for i := range entries {
+		e := entries[(l.index+i)%len(entries)]
+		if n := e.Active(); best == nil || n < active {
+			best = e
+			active = n
+		}
+	}
+
+	l.index += 1
+
+	return best
+}
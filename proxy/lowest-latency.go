@@ -0,0 +1,42 @@
+package proxy
+
+import "time"
+
+// LowestLatency picks the chain with the lowest average dial duration.
+// Chains without measurements are picked first
+type LowestLatency struct {
+	chainList
+	index int
+}
+
+func (l *LowestLatency) Next() *Entry {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.pick(l.available("", false))
+}
+
+func (l *LowestLatency) NextGroup(group string) *Entry {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.pick(l.available(group, true))
+}
+
+func (l *LowestLatency) pick(entries []*Entry) *Entry {
+	var (
+		best    *Entry
+		latency time.Duration
+	)
+
+	// ties are broken in round robin order
+	for i := range entries {
+		e := entries[(l.index+i)%len(entries)]
+		if d := e.Latency(); best == nil || d < latency {
+			best = e
+			latency = d
+		}
+	}
+
+	l.index += 1
+
+	return best
+}
@@ -1,12 +1,141 @@
 package proxy
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
+	"io"
+	"strconv"
 	"strings"
+	"sync"
 )
 
-var globalKWArgs = map[string]string{}
+var (
+	globalKWArgs = map[string]string{}
+	// held while parsing, as globalKWArgs persists between lines and files
+	parseMutex sync.Mutex
+)
+
+// parseConfig reads the chains and routing rules of a config file
+func parseConfig(f io.Reader) ([]Chain, []Rule, error) {
+	var (
+		chains []Chain
+		rules  []Rule
+		// name of the `group name { ... }` block being read
+		group string
+	)
+
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields, err := parseFields(line)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if len(fields) == 0 {
+			continue
+		}
+
+		if fields[0] == "group" {
+			if len(fields) != 3 || fields[2] != "{" {
+				return nil, nil, fmt.Errorf("config: expected `group name {`, got `%s`", line)
+			}
+			if len(group) != 0 {
+				return nil, nil, fmt.Errorf("config: group `%s` declared inside group `%s`", fields[1], group)
+			}
+			group = fields[1]
+			continue
+		}
+
+		if fields[0] == "}" {
+			if len(fields) != 1 || len(group) == 0 {
+				return nil, nil, fmt.Errorf("config: unexpected `%s`", line)
+			}
+			group = ""
+			continue
+		}
+
+		if fields[0] == "route" {
+			rule, err := parseRule(fields[1:])
+			if err != nil {
+				return nil, nil, err
+			}
+			rules = append(rules, rule)
+			continue
+		}
+
+		chain, err := parseChain(fields)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if len(chain) == 0 {
+			continue
+		}
+
+		if len(group) != 0 {
+			chain = chain.withGroup(group)
+		}
+
+		chains = append(chains, chain)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	if len(group) != 0 {
+		return nil, nil, fmt.Errorf("config: group `%s` is not closed", group)
+	}
+
+	return chains, rules, nil
+}
+
+// ParseChain parses a single chain line, as if it was the first line of a
+// config file
+func ParseChain(line string) (Chain, error) {
+	parseMutex.Lock()
+	defer parseMutex.Unlock()
+
+	kwargs := globalKWArgs
+	globalKWArgs = map[string]string{}
+	defer func() { globalKWArgs = kwargs }()
+
+	fields, err := parseFields(line)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(fields) == 0 {
+		return nil, errors.New("config: empty chain")
+	}
+
+	chain, err := parseChain(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(chain) == 0 {
+		return nil, errors.New("config: expected at least one proxy")
+	}
+
+	for _, p := range chain {
+		if _, ok := p.GroupRef(); ok {
+			continue
+		}
+		if _, err := p.ToDialer(); err != nil {
+			return nil, err
+		}
+	}
+
+	return chain, nil
+}
 
 func parseFields(line string) ([]string, error) {
 	ret := make([]string, 0)
@@ -106,6 +235,19 @@ func parseQuoted(line string) (string, int, error) {
 	return "", 0, fmt.Errorf("config: unterminated string `%s`", line)
 }
 
+var quoteReplacer = strings.NewReplacer(
+	`\`, `\\`, `"`, `\"`,
+	"\a", `\a`, "\b", `\b`, "\t", `\t`, "\n", `\n`, "\f", `\f`, "\r", `\r`, "\v", `\v`,
+)
+
+// quoteField quotes s if parseFields would not read it back as a single field
+func quoteField(s string) string {
+	if len(s) != 0 && !strings.ContainsAny(s, " \t\r\n\v\f|\"'#") {
+		return s
+	}
+	return `"` + quoteReplacer.Replace(s) + `"`
+}
+
 func parseChain(args []string) (Chain, error) {
 	split := make([][]string, 0)
 	opts := make([]string, 0)
@@ -153,13 +295,27 @@ func parseChain(args []string) (Chain, error) {
 			continue
 		}
 
-		if len(opts) < 2 {
+		if _, ok := p.GroupRef(); ok {
+			if len(opts) != 1 || len(p.Protocol) == 1 {
+				return nil, fmt.Errorf("config: expected `@group`, got `%s`", strings.Join(opts, " "))
+			}
+			r = append(r, p)
+			continue
+		}
+
+		if len(opts) < 2 && !isPseudoProtocol(p.Protocol) {
 			return nil, errors.New("config: found invalid proxy chain")
 		}
 
 		r = append(r, p)
 	}
 
+	for _, p := range r {
+		if isPseudoProtocol(p.Protocol) && len(r) != 1 {
+			return nil, fmt.Errorf("config: %s must be the only proxy of a chain", p.Protocol)
+		}
+	}
+
 	if len(r) == 0 && len(split) >= 1 {
 		// changing global kwargs
 		globalKWArgs = kwargs
@@ -188,6 +344,11 @@ func handleKWArgs(p *ProxyInfo, root map[string]string) (map[string]string, erro
 		if len(p.Args) != 1 {
 			return nil, fmt.Errorf("config: expected `set key value`, got `set %s`", p.Address)
 		}
+		if p.Address == "Weight" {
+			if n, err := strconv.Atoi(p.Args[0]); err != nil || n < 0 {
+				return nil, fmt.Errorf("config: Weight must be a non-negative integer, got `%s`", p.Args[0])
+			}
+		}
 		r[p.Address] = p.Args[0]
 	case "unset":
 		delete(r, p.Address)
@@ -2,12 +2,19 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/sloweax/socksx/proxy/http"
 	"github.com/sloweax/socksx/proxy/socks4"
 	"github.com/sloweax/socksx/proxy/socks5"
+	"github.com/sloweax/socksx/proxy/ssh"
 )
 
 type ProxyInfo struct {
@@ -15,16 +22,64 @@ type ProxyInfo struct {
 	Address  string
 	Args     []string
 	KWArgs   map[string]string
+	// previous proxies of the chain, used by the `dns` resolver
+	via *Dialer
+	// returns a chain of a group, used by `@group` references
+	lookup func(group string) (Chain, error)
+	// set when the chain is added to a picker, shared by copies of p
+	cache *dialerCache
+	// set for chains added for a routing rule
+	implicit bool
+}
+
+// dialerCache holds what is expensive to build from a ProxyInfo, so it is
+// not done again for every connection
+type dialerCache struct {
+	mutex sync.Mutex
+	tls   *tls.Config
+	ssh   *ssh.Client
+}
+
+// reset drops the cached values, files they were read from are read again
+// on next use. Open connections are left alone
+func (c *dialerCache) reset() {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.tls = nil
+	if c.ssh != nil {
+		c.ssh.Retire()
+		c.ssh = nil
+	}
 }
 
 type Chain []ProxyInfo
 
 type ChainPicker interface {
 	Load(io.Reader) error
-	Add(Chain)
-	Next() Chain
-	All() []Chain
+	// Reload atomically replaces every chain and rule
+	Reload(...io.Reader) error
+	Add(Chain) *Entry
+	Get(id int) *Entry
+	Remove(id int) bool
+	// Disable takes an entry out of rotation until Enable is called
+	Disable(id int) bool
+	Enable(id int) bool
+	Next() *Entry
+	NextGroup(string) *Entry
+	All() []*Entry
 	Len() int
+	// Report gives feedback about a dial through an entry and how long it took
+	Report(*Entry, time.Duration, error)
+	// Connected and Disconnected track open connections through an entry
+	Connected(*Entry)
+	Disconnected(*Entry)
+	SetCircuitBreaker(CircuitBreaker)
+	// Route returns the group of the first routing rule matching address
+	Route(address string) (string, bool)
+	Rules() []Rule
 }
 
 type ProxyDialer interface {
@@ -34,17 +89,52 @@ type ProxyDialer interface {
 	DialContextWithConn(ctx context.Context, conn net.Conn, network, address string) (net.Conn, error)
 }
 
+type PacketDialer interface {
+	ListenPacketWithConn(ctx context.Context, conn net.Conn) (net.PacketConn, error)
+}
+
+type BindDialer interface {
+	BindWithConn(ctx context.Context, conn net.Conn, address string) (net.Listener, error)
+}
+
 func (p *ProxyInfo) ToDialer() (ProxyDialer, error) {
+	if p.Protocol == "https" {
+		return p.ToTLS("http")
+	}
+
+	if strings.HasSuffix(p.Protocol, "+tls") {
+		return p.ToTLS(strings.TrimSuffix(p.Protocol, "+tls"))
+	}
+
 	switch p.Protocol {
 	case "socks5", "socks5h":
 		return p.ToSOCKS5()
 	case "socks4", "socks4a":
 		return p.ToSOCKS4()
+	case "http":
+		return p.ToHTTP()
+	case "ssh":
+		return p.ToSSH()
+	case "direct":
+		return p.ToDirect()
+	case "reject":
+		return p.ToReject()
 	default:
 		return nil, fmt.Errorf("cannot convert %s to dialer", p.Protocol)
 	}
 }
 
+// ToTLS converts p to a dialer of protocol that wraps its connection in TLS
+func (p *ProxyInfo) ToTLS(protocol string) (ProxyDialer, error) {
+	inner := *p
+	inner.Protocol = protocol
+	d, err := inner.ToDialer()
+	if err != nil {
+		return nil, err
+	}
+	return p.newTLSDialer(d)
+}
+
 func (p *ProxyInfo) ToSOCKS4() (ProxyDialer, error) {
 	if len(p.Args) > 1 {
 		return nil, fmt.Errorf("%s: invalid proxy options", p.Protocol)
@@ -53,6 +143,11 @@ func (p *ProxyInfo) ToSOCKS4() (ProxyDialer, error) {
 	if p.Protocol == "socks4a" {
 		config.T = socks4.TypeA
 	}
+	resolver, err := p.resolver()
+	if err != nil {
+		return nil, err
+	}
+	config.Resolver = resolver
 	if len(p.Args) == 1 {
 		config.ID = p.Args[0]
 	}
@@ -62,6 +157,14 @@ func (p *ProxyInfo) ToSOCKS4() (ProxyDialer, error) {
 func (p *ProxyInfo) ToSOCKS5() (ProxyDialer, error) {
 	config := socks5.Config{}
 	config.Methods = append(config.Methods, socks5.MethodNoAuth)
+	if p.Protocol == "socks5h" {
+		config.T = socks5.TypeH
+	}
+	resolver, err := p.resolver()
+	if err != nil {
+		return nil, err
+	}
+	config.Resolver = resolver
 
 	switch len(p.Args) {
 	case 0:
@@ -79,6 +182,92 @@ func (p *ProxyInfo) ToSOCKS5() (ProxyDialer, error) {
 
 }
 
+func (p *ProxyInfo) ToHTTP() (ProxyDialer, error) {
+	config := http.Config{}
+
+	switch len(p.Args) {
+	case 0:
+		return http.NewDialer("tcp", p.Address, p.KWArgs, config), nil
+	default:
+		return nil, fmt.Errorf("%s: invalid proxy options", p.Protocol)
+	case 2:
+		config.Password = p.Args[1]
+		fallthrough
+	case 1:
+		config.Username = p.Args[0]
+		return http.NewDialer("tcp", p.Address, p.KWArgs, config), nil
+	}
+}
+
+// ToSSH converts `ssh [user@]host:port [key=file] [password=pass] [known_hosts=file]`
+func (p *ProxyInfo) ToSSH() (ProxyDialer, error) {
+	config := ssh.Config{}
+	address := p.Address
+
+	if user, host, ok := strings.Cut(p.Address, "@"); ok {
+		config.User = user
+		address = host
+	}
+
+	for _, arg := range p.Args {
+		k, v, ok := strings.Cut(arg, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s: invalid proxy option `%s`", p.Protocol, arg)
+		}
+		switch k {
+		case "key":
+			config.Key = v
+		case "password":
+			config.Password = v
+		case "known_hosts":
+			config.KnownHosts = v
+		default:
+			return nil, fmt.Errorf("%s: unknown proxy option `%s`", p.Protocol, k)
+		}
+	}
+
+	client, err := p.sshClient(address, config)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", p.Protocol, err)
+	}
+
+	return ssh.NewDialer("tcp", address, p.KWArgs, client), nil
+}
+
+// sshClient returns the cached ssh client of p
+func (p *ProxyInfo) sshClient(address string, config ssh.Config) (*ssh.Client, error) {
+	if p.cache == nil {
+		return ssh.NewClient(address, config)
+	}
+
+	p.cache.mutex.Lock()
+	defer p.cache.mutex.Unlock()
+
+	if p.cache.ssh == nil {
+		client, err := ssh.NewClient(address, config)
+		if err != nil {
+			return nil, err
+		}
+		p.cache.ssh = client
+	}
+
+	return p.cache.ssh, nil
+}
+
+func (p *ProxyInfo) resolver() (Resolver, error) {
+	s, ok := p.KWArgs["Resolver"]
+	if !ok {
+		return nil, nil
+	}
+
+	r, err := NewResolver(s, p.via)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", p.Protocol, err)
+	}
+
+	return r, nil
+}
+
 func (p *ProxyInfo) String() string {
 	a := p.Protocol
 	if len(p.Address) != 0 {
@@ -93,16 +282,130 @@ func (p *ProxyInfo) String() string {
 	return a
 }
 
-func (c Chain) ToDialer() (*Dialer, error) {
-	dialers := make([]ProxyDialer, len(c))
+func (c Chain) String() string {
+	a := make([]string, len(c))
+	for i, p := range c {
+		a[i] = p.Protocol
+		if len(p.Address) != 0 {
+			a[i] += " " + p.Address
+		}
+	}
+	return strings.Join(a, " | ")
+}
+
+// Format returns c in config syntax. Key value pairs are written before the
+// proxies they apply to, so the line does not depend on previous lines
+func (c Chain) Format() string {
+	a := make([]string, 0, len(c))
+	kwargs := map[string]string{}
+
+	for _, p := range c {
+		keys := make([]string, 0, len(kwargs)+len(p.KWArgs))
+		for k := range kwargs {
+			if _, ok := p.KWArgs[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		for k := range p.KWArgs {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			v, ok := p.KWArgs[k]
+			prev, had := kwargs[k]
+			switch {
+			case !ok:
+				a = append(a, "unset "+quoteField(k))
+			case !had || prev != v:
+				a = append(a, fmt.Sprintf("set %s %s", quoteField(k), quoteField(v)))
+			}
+		}
+		kwargs = p.KWArgs
+
+		fields := []string{quoteField(p.Protocol)}
+		if len(p.Address) != 0 || len(p.Args) != 0 {
+			fields = append(fields, quoteField(p.Address))
+		}
+		for _, arg := range p.Args {
+			fields = append(fields, quoteField(arg))
+		}
+		a = append(a, strings.Join(fields, " "))
+	}
+
+	return strings.Join(a, " | ")
+}
+
+func (c Chain) Group() string {
+	if len(c) == 0 {
+		return ""
+	}
+	return c[0].KWArgs["Group"]
+}
 
+// withGroup returns a copy of c that belongs to group
+func (c Chain) withGroup(group string) Chain {
+	r := make(Chain, len(c))
 	for i, p := range c {
+		kwargs := make(map[string]string, len(p.KWArgs)+1)
+		for k, v := range p.KWArgs {
+			kwargs[k] = v
+		}
+		kwargs["Group"] = group
+		p.KWArgs = kwargs
+		r[i] = p
+	}
+	return r
+}
+
+// maximum depth of nested `@group` references
+const maxGroupDepth = 8
+
+// ToDialer converts c to a dialer. `@group` references are replaced by a
+// random available chain of group
+func (c Chain) ToDialer() (*Dialer, error) {
+	dialers, err := c.appendDialers(make([]ProxyDialer, 0, len(c)), 0)
+	if err != nil {
+		return nil, err
+	}
+	return New(dialers...), nil
+}
+
+func (c Chain) appendDialers(dialers []ProxyDialer, depth int) ([]ProxyDialer, error) {
+	for _, p := range c {
+		if group, ok := p.GroupRef(); ok {
+			if depth >= maxGroupDepth {
+				return nil, fmt.Errorf("@%s: too many nested group references", group)
+			}
+			if p.lookup == nil {
+				return nil, fmt.Errorf("@%s: unknown group", group)
+			}
+			member, err := p.lookup(group)
+			if err != nil {
+				return nil, fmt.Errorf("@%s: %w", group, err)
+			}
+			dialers, err = member.appendDialers(dialers, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		p.via = New(dialers...)
 		d, err := p.ToDialer()
 		if err != nil {
 			return nil, err
 		}
-		dialers[i] = d
+		dialers = append(dialers, d)
 	}
 
-	return New(dialers...), nil
+	return dialers, nil
+}
+
+// GroupRef returns the group name of `@group` references
+func (p *ProxyInfo) GroupRef() (string, bool) {
+	if !strings.HasPrefix(p.Protocol, "@") {
+		return "", false
+	}
+	return p.Protocol[1:], true
 }
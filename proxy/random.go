@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	"math/rand"
+	"time"
+)
+
+type Random struct {
+	chainList
+	rand *rand.Rand
+}
+
+func (r *Random) Next() *Entry {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.pick(r.available("", false))
+}
+
+func (r *Random) NextGroup(group string) *Entry {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.pick(r.available(group, true))
+}
+
+func (r *Random) pick(entries []*Entry) *Entry {
+	if len(entries) == 0 {
+		return nil
+	}
+	if r.rand == nil {
+		r.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return entries[r.rand.Intn(len(entries))]
+}
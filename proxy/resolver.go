@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Resolver interface {
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+// Hosts resolves hostnames from a static hosts file
+type Hosts map[string][]net.IP
+
+type hostsEntry struct {
+	modtime time.Time
+	hosts   Hosts
+}
+
+var (
+	hostsMutex sync.Mutex
+	hostsCache = map[string]hostsEntry{}
+)
+
+// NewResolver creates a resolver from a `Resolver` kwarg value:
+//
+//	system           the system resolver
+//	hosts:<file>     static hosts file
+//	dns:<host:port>  DNS over TCP, dialed through via (directly if via is nil)
+func NewResolver(s string, via *Dialer) (Resolver, error) {
+	kind, arg, _ := strings.Cut(s, ":")
+
+	switch kind {
+	case "system":
+		return net.DefaultResolver, nil
+	case "hosts":
+		return LoadHostsFile(arg)
+	case "dns":
+		if _, _, err := net.SplitHostPort(arg); err != nil {
+			return nil, fmt.Errorf("resolver: %w", err)
+		}
+		return NewDNSResolver(arg, via), nil
+	default:
+		return nil, fmt.Errorf("resolver: unknown resolver `%s`", s)
+	}
+}
+
+func NewDNSResolver(nameserver string, via *Dialer) *net.Resolver {
+	r := new(net.Resolver)
+	r.PreferGo = true
+	r.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		// a stream conn makes the resolver use DNS over TCP
+		if via == nil || len(via.proxies) == 0 {
+			dialer := net.Dialer{}
+			return dialer.DialContext(ctx, "tcp", nameserver)
+		}
+		return via.DialContext(ctx, "tcp", nameserver)
+	}
+	return r
+}
+
+// LoadHostsFile loads and caches file until it is modified
+func LoadHostsFile(file string) (Hosts, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+
+	hostsMutex.Lock()
+	defer hostsMutex.Unlock()
+
+	if e, ok := hostsCache[file]; ok && e.modtime.Equal(info.ModTime()) {
+		return e.hosts, nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hosts, err := ParseHosts(f)
+	if err != nil {
+		return nil, err
+	}
+
+	hostsCache[file] = hostsEntry{modtime: info.ModTime(), hosts: hosts}
+
+	return hosts, nil
+}
+
+func ParseHosts(r io.Reader) (Hosts, error) {
+	hosts := Hosts{}
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			return nil, fmt.Errorf("hosts: invalid ip `%s`", fields[0])
+		}
+
+		for _, name := range fields[1:] {
+			name = strings.ToLower(name)
+			hosts[name] = append(hosts[name], ip)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return hosts, nil
+}
+
+func (h Hosts) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	ips := make([]net.IP, 0)
+
+	for _, ip := range h[strings.ToLower(strings.TrimSuffix(host, "."))] {
+		switch {
+		case network == "ip4" && ip.To4() == nil:
+		case network == "ip6" && ip.To4() != nil:
+		default:
+			ips = append(ips, ip)
+		}
+	}
+
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	return ips, nil
+}
@@ -1,77 +1,38 @@
 package proxy
 
-import (
-	"bufio"
-	"io"
-	"strings"
-	"sync"
-)
-
 type RoundRobin struct {
-	mutex  sync.RWMutex
-	index  int
-	chains []Chain
+	chainList
+	index   int
+	indexes map[string]int
 }
 
-func (r *RoundRobin) Add(c Chain) {
+func (r *RoundRobin) Next() *Entry {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
-	r.chains = append(r.chains, c)
-}
-
-func (r *RoundRobin) Next() Chain {
-	r.mutex.RLock()
-	defer r.mutex.RUnlock()
-	chain := r.chains[r.index%len(r.chains)]
+	entries := r.available("", false)
+	if len(entries) == 0 {
+		return nil
+	}
+	entry := entries[r.index%len(entries)]
 	r.index += 1
-	return chain
+	return entry
 }
 
-func (r *RoundRobin) Len() int {
-	r.mutex.RLock()
-	defer r.mutex.RUnlock()
-	return len(r.chains)
-}
-
-func (r *RoundRobin) Load(f io.Reader) error {
-	scanner := bufio.NewScanner(f)
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(line, "#") {
-			continue
-		}
-
-		fields, err := parseFields(line)
-		if err != nil {
-			return err
-		}
-
-		if len(fields) == 0 {
-			continue
-		}
-
-		chain, err := parseChain(fields)
-		if err != nil {
-			return err
-		}
-
-		if len(chain) == 0 {
-			continue
-		}
+func (r *RoundRobin) NextGroup(group string) *Entry {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
 
-		r.Add(chain)
+	entries := r.available(group, true)
+	if len(entries) == 0 {
+		return nil
 	}
 
-	if err := scanner.Err(); err != nil {
-		return err
+	if r.indexes == nil {
+		r.indexes = map[string]int{}
 	}
 
-	return nil
-}
+	index := r.indexes[group]
+	r.indexes[group] = index + 1
 
-func (r *RoundRobin) All() []Chain {
-	r.mutex.RLock()
-	defer r.mutex.RUnlock()
-	return r.chains
+	return entries[index%len(entries)]
 }
@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Rule routes connections whose target matches it through the chains of
+// Group. It is written in the config as `route <matcher> <value> <group>`,
+// or `route default <group>`
+type Rule struct {
+	Matcher string
+	Value   string
+	Group   string
+
+	match func(host string, port uint16) bool
+}
+
+func parseRule(args []string) (Rule, error) {
+	r := Rule{}
+
+	switch len(args) {
+	case 2:
+		if args[0] != "default" {
+			return Rule{}, fmt.Errorf("config: expected `route <matcher> <value> <group>`, got `route %s`", strings.Join(args, " "))
+		}
+		r.Matcher = args[0]
+		r.Group = args[1]
+	case 3:
+		r.Matcher = args[0]
+		r.Value = args[1]
+		r.Group = args[2]
+	default:
+		return Rule{}, fmt.Errorf("config: expected `route <matcher> <value> <group>`, got `route %s`", strings.Join(args, " "))
+	}
+
+	switch r.Matcher {
+	case "default":
+		r.match = func(string, uint16) bool { return true }
+	case "domain":
+		suffix := strings.ToLower(strings.TrimPrefix(r.Value, "."))
+		r.match = func(host string, _ uint16) bool {
+			return host == suffix || strings.HasSuffix(host, "."+suffix)
+		}
+	case "glob":
+		pattern := strings.ToLower(r.Value)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return Rule{}, fmt.Errorf("config: invalid glob `%s`: %w", r.Value, err)
+		}
+		r.match = func(host string, _ uint16) bool {
+			ok, _ := path.Match(pattern, host)
+			return ok
+		}
+	case "regex":
+		// hosts are matched lowercased
+		re, err := regexp.Compile("(?i)" + r.Value)
+		if err != nil {
+			return Rule{}, fmt.Errorf("config: invalid regex `%s`: %w", r.Value, err)
+		}
+		r.match = func(host string, _ uint16) bool {
+			return re.MatchString(host)
+		}
+	case "cidr":
+		_, network, err := net.ParseCIDR(r.Value)
+		if err != nil {
+			return Rule{}, fmt.Errorf("config: invalid cidr `%s`: %w", r.Value, err)
+		}
+		r.match = func(host string, _ uint16) bool {
+			ip := net.ParseIP(host)
+			return ip != nil && network.Contains(ip)
+		}
+	case "port":
+		min, max, err := parsePortRange(r.Value)
+		if err != nil {
+			return Rule{}, err
+		}
+		r.match = func(_ string, port uint16) bool {
+			return port >= min && port <= max
+		}
+	default:
+		return Rule{}, fmt.Errorf("config: unknown route matcher `%s`", r.Matcher)
+	}
+
+	return r, nil
+}
+
+// parsePortRange parses `port` or `min-max`
+func parsePortRange(s string) (uint16, uint16, error) {
+	minstr, maxstr, ok := strings.Cut(s, "-")
+	if !ok {
+		maxstr = minstr
+	}
+
+	min, err := strconv.ParseUint(minstr, 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("config: invalid port range `%s`", s)
+	}
+
+	max, err := strconv.ParseUint(maxstr, 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("config: invalid port range `%s`", s)
+	}
+
+	if min > max {
+		return 0, 0, fmt.Errorf("config: invalid port range `%s`", s)
+	}
+
+	return uint16(min), uint16(max), nil
+}
+
+// Match reports whether address (host:port) matches r. Hostnames are not
+// resolved, so cidr rules only match ip addresses
+func (r *Rule) Match(address string) bool {
+	host, portstr, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+
+	port, err := strconv.ParseUint(portstr, 10, 16)
+	if err != nil {
+		return false
+	}
+
+	return r.match(strings.ToLower(strings.TrimSuffix(host, ".")), uint16(port))
+}
+
+// Format returns r in config syntax
+func (r *Rule) Format() string {
+	if r.Matcher == "default" {
+		return "route default " + quoteField(r.Group)
+	}
+	return fmt.Sprintf("route %s %s %s", quoteField(r.Matcher), quoteField(r.Value), quoteField(r.Group))
+}
+
+func (r *Rule) String() string {
+	if r.Matcher == "default" {
+		return fmt.Sprintf("route default %s", r.Group)
+	}
+	return fmt.Sprintf("route %s %s %s", r.Matcher, r.Value, r.Group)
+}
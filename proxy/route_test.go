@@ -0,0 +1,71 @@
+package proxy
+
+import "testing"
+
+func TestRuleMatch(t *testing.T) {
+	tests := []struct {
+		rule    string
+		address string
+		want    bool
+	}{
+		{"domain example.com", "example.com:80", true},
+		{"domain example.com", "www.example.com:443", true},
+		{"domain example.com", "WWW.Example.COM:443", true},
+		{"domain example.com", "example.com.:80", true},
+		{"domain .Example.com", "a.example.com:80", true},
+		{"domain example.com", "badexample.com:80", false},
+		{"domain example.com", "example.com.evil:80", false},
+		{"glob *.dev.example.com", "api.dev.example.com:80", true},
+		{"glob *.dev.example.com", "API.DEV.example.com:80", true},
+		{"glob *.Dev.example.com", "api.dev.example.com:80", true},
+		{"glob *.dev.example.com", "dev.example.com:80", false},
+		{"regex ^db[0-9]+\\.", "db12.internal:5432", true},
+		{"regex ^db[0-9]+\\.", "DB12.internal:5432", true},
+		{"regex ^DB[0-9]+\\.", "db12.internal:5432", true},
+		{"regex ^db[0-9]+\\.", "web.internal:80", false},
+		{"cidr 10.0.0.0/8", "10.1.2.3:22", true},
+		{"cidr 10.0.0.0/8", "11.1.2.3:22", false},
+		{"cidr 10.0.0.0/8", "ten.example.com:22", false},
+		{"cidr fd00::/8", "[fd00::1]:22", true},
+		{"port 25", "mail.example.com:25", true},
+		{"port 25", "mail.example.com:26", false},
+		{"port 6000-7000", "1.2.3.4:6500", true},
+		{"port 6000-7000", "1.2.3.4:7001", false},
+		{"default", "anything:1", true},
+		{"domain example.com", "example.com", false},
+	}
+
+	for _, tt := range tests {
+		fields, err := parseFields(tt.rule + " group")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := parseRule(fields)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.rule, err)
+		}
+		if got := r.Match(tt.address); got != tt.want {
+			t.Errorf("%s: Match(%s) = %v, want %v", tt.rule, tt.address, got, tt.want)
+		}
+	}
+}
+
+func TestParseRuleInvalid(t *testing.T) {
+	rules := [][]string{
+		{"domain", "example.com"},
+		{"default"},
+		{"unknown", "x", "group"},
+		{"glob", "[", "group"},
+		{"regex", "(", "group"},
+		{"cidr", "10.0.0.0", "group"},
+		{"port", "70000", "group"},
+		{"port", "20-10", "group"},
+		{"port", "a-b", "group"},
+	}
+
+	for _, args := range rules {
+		if _, err := parseRule(args); err == nil {
+			t.Errorf("parseRule(%q): expected an error", args)
+		}
+	}
+}
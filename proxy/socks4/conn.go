@@ -7,8 +7,9 @@ import (
 
 type Conn struct {
 	remote Addr
-	local  net.Addr
-	conn   net.Conn
+	// address bound by the proxy
+	local Addr
+	conn  net.Conn
 }
 
 func (c *Conn) Read(b []byte) (int, error) {
@@ -24,7 +25,7 @@ func (c *Conn) Write(b []byte) (int, error) {
 }
 
 func (c *Conn) LocalAddr() net.Addr {
-	return c.local
+	return &c.local
 }
 
 func (c *Conn) RemoteAddr() net.Addr {
@@ -10,9 +10,15 @@ import (
 	"strconv"
 )
 
+type Resolver interface {
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
 type Config struct {
 	ID string
 	T  int
+	// used to resolve hostnames for socks4, defaults to net.DefaultResolver
+	Resolver Resolver
 }
 
 type Dialer struct {
@@ -30,13 +36,22 @@ type Addr struct {
 
 type AddressType int
 
+var (
+	ErrRejected         = errors.New("request rejected or failed")
+	ErrIdentUnreachable = errors.New("request rejected, could not connect to identd on the client")
+	ErrIdentMismatch    = errors.New("request rejected, client program and identd report different user-ids")
+	ErrUnknownReply     = errors.New("unknown reply")
+)
+
 const (
 	Version byte = 4
 
 	CmdConnect byte = 1
 
-	ReplyOK       byte = 90
-	ReplyRejected byte = 91
+	ReplyOK               byte = 90
+	ReplyRejected         byte = 91
+	ReplyIdentUnreachable byte = 92
+	ReplyIdentMismatch    byte = 93
 
 	TypeA = 1
 
@@ -76,7 +91,7 @@ func (d *Dialer) Network() string {
 }
 
 func (d *Dialer) request(rw io.ReadWriter, cmd byte, address string) error {
-	addr, err := NewAddress(address, d.config.T)
+	addr, err := NewAddress(address)
 	if err != nil {
 		return err
 	}
@@ -85,11 +100,16 @@ func (d *Dialer) request(rw io.ReadWriter, cmd byte, address string) error {
 		return errors.New("could not get ipv4 of hostname")
 	}
 
-	buf := make([]byte, 0, 8+len(d.config.ID)+2)
+	buf := make([]byte, 0, 8+len(d.config.ID)+1+len(addr.host)+1)
 	buf = append(buf, Version, cmd)
 	buf = append(buf, addr.Bytes()...)
 	buf = append(buf, []byte(d.config.ID)...)
 	buf = append(buf, 0)
+	if addr.t != AtypIPv4 {
+		// socks4a: the hostname follows the user-id
+		buf = append(buf, []byte(addr.host)...)
+		buf = append(buf, 0)
+	}
 
 	if _, err := rw.Write(buf); err != nil {
 		return err
@@ -130,25 +150,31 @@ func (d *Dialer) DialContextWithConn(ctx context.Context, conn net.Conn, network
 
 	go func() {
 		defer close(cresult)
+		address, err := d.resolve(ctx, address)
+		if err != nil {
+			cresult <- result{err: err}
+			return
+		}
+
 		if err := d.request(conn, CmdConnect, address); err != nil {
 			cresult <- result{err: err}
 			return
 		}
 
-		reply, _, err := d.response(conn)
+		reply, bnd, err := d.response(conn)
 		if err != nil {
 			cresult <- result{err: err}
 			return
 		}
 
-		if reply != ReplyOK {
-			cresult <- result{err: fmt.Errorf("request rejected")}
+		if err := ReplyErr(reply); err != nil {
+			cresult <- result{err: err}
 			return
 		}
 
 		c := Conn{}
-		c.local = conn.LocalAddr()
-		c.remote, _ = NewAddress(address, d.config.T)
+		c.local = bnd
+		c.remote, _ = NewAddress(address)
 		c.conn = conn
 		cresult <- result{conn: &c}
 	}()
@@ -162,7 +188,42 @@ func (d *Dialer) DialContextWithConn(ctx context.Context, conn net.Conn, network
 	}
 }
 
-func NewAddress(addr string, t int) (Addr, error) {
+// resolve replaces the hostname of address with its ipv4, unless the proxy
+// is expected to resolve it
+func (d *Dialer) resolve(ctx context.Context, address string) (string, error) {
+	if d.config.T == TypeA {
+		return address, nil
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+
+	if net.ParseIP(host) != nil {
+		return address, nil
+	}
+
+	var resolver Resolver = net.DefaultResolver
+	if d.config.Resolver != nil {
+		resolver = d.config.Resolver
+	}
+
+	ips, err := resolver.LookupIP(ctx, "ip4", host)
+	if err != nil {
+		return "", err
+	}
+
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return net.JoinHostPort(ip.To4().String(), port), nil
+		}
+	}
+
+	return "", errors.New("could not get ipv4 of hostname")
+}
+
+func NewAddress(addr string) (Addr, error) {
 	a := Addr{}
 
 	host, portstr, err := net.SplitHostPort(addr)
@@ -189,55 +250,51 @@ func NewAddress(addr string, t int) (Addr, error) {
 		a.host = host
 	}
 
-	if a.t == AtypDomainName && t == 0 {
-		ips, err := net.LookupIP(host)
-		if err != nil {
-			return Addr{}, err
-		}
-		for _, ip := range ips {
-			if ip.To4() != nil {
-				a.host = ip.To4().String()
-				a.t = AtypIPv4
-				break
-			}
-		}
-		if a.t != AtypIPv4 {
-			return Addr{}, errors.New("could not get ipv4 of hostname")
-		}
-	}
-
 	return a, nil
 }
 
+// Bytes returns DSTPORT and DSTIP. For socks4a hostnames DSTIP is 0.0.0.1
+// and the hostname must be sent after the user-id
 func (a *Addr) Bytes() []byte {
-	buf := make([]byte, 0, net.IPv4len+2)
+	buf := make([]byte, 0, 2+net.IPv4len)
 	buf = binary.BigEndian.AppendUint16(buf, a.port)
 	switch a.t {
 	case AtypIPv4:
 		ip := net.ParseIP(a.host).To4()
 		buf = append(buf, ip[:net.IPv4len]...)
 	case AtyIPv6, AtypDomainName:
-		ip := net.IPv4(0, 0, 0, 1)
-		buf = append(buf, ip[:net.IPv4len]...)
-		buf = append(buf, []byte(a.String())...)
-		buf = append(buf, 0)
+		buf = append(buf, 0, 0, 0, 1)
 	}
 	return buf
 }
 
-func ReadAddress(rw io.ReadWriter) (Addr, error) {
+func ReadAddress(r io.Reader) (Addr, error) {
 	a := Addr{}
 	buf := make([]byte, 2+net.IPv4len)
-	if _, err := io.ReadFull(rw, buf); err != nil {
+	if _, err := io.ReadFull(r, buf); err != nil {
 		return Addr{}, err
 	}
+	a.t = AtypIPv4
 	a.port = binary.BigEndian.Uint16(buf[:2])
-	ip := net.IP{}
-	ip = append(ip, buf[2:]...)
-	a.host = ip.To4().String()
+	a.host = net.IPv4(buf[2], buf[3], buf[4], buf[5]).String()
 	return a, nil
 }
 
+func ReplyErr(reply byte) error {
+	switch reply {
+	case ReplyOK:
+		return nil
+	case ReplyRejected:
+		return ErrRejected
+	case ReplyIdentUnreachable:
+		return ErrIdentUnreachable
+	case ReplyIdentMismatch:
+		return ErrIdentMismatch
+	default:
+		return ErrUnknownReply
+	}
+}
+
 func (a *Addr) Network() string {
 	return "tcp"
 }
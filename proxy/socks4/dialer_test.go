@@ -0,0 +1,128 @@
+package socks4
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		address string
+		want    []byte
+	}{
+		{
+			name:    "socks4",
+			config:  Config{ID: "bob"},
+			address: "1.2.3.4:80",
+			want:    []byte{4, 1, 0, 80, 1, 2, 3, 4, 'b', 'o', 'b', 0},
+		},
+		{
+			name:    "socks4a hostname",
+			config:  Config{ID: "bob", T: TypeA},
+			address: "example.com:443",
+			want: append([]byte{4, 1, 1, 187, 0, 0, 0, 1, 'b', 'o', 'b', 0},
+				append([]byte("example.com"), 0)...),
+		},
+		{
+			name:    "socks4a empty id",
+			config:  Config{T: TypeA},
+			address: "example.com:80",
+			want:    append([]byte{4, 1, 0, 80, 0, 0, 0, 1, 0}, append([]byte("example.com"), 0)...),
+		},
+		{
+			name:    "socks4a ip",
+			config:  Config{T: TypeA},
+			address: "1.2.3.4:80",
+			want:    []byte{4, 1, 0, 80, 1, 2, 3, 4, 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDialer("tcp", "127.0.0.1:1080", nil, tt.config)
+			buf := bytes.Buffer{}
+			if err := d.request(&buf, CmdConnect, tt.address); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), tt.want) {
+				t.Fatalf("got %v, want %v", buf.Bytes(), tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestSocks4Hostname(t *testing.T) {
+	d := NewDialer("tcp", "127.0.0.1:1080", nil, Config{})
+	if err := d.request(&bytes.Buffer{}, CmdConnect, "example.com:80"); err == nil {
+		t.Fatal("expected an error for a socks4 hostname request")
+	}
+}
+
+func TestReplyErr(t *testing.T) {
+	tests := []struct {
+		reply byte
+		want  error
+	}{
+		{ReplyOK, nil},
+		{ReplyRejected, ErrRejected},
+		{ReplyIdentUnreachable, ErrIdentUnreachable},
+		{ReplyIdentMismatch, ErrIdentMismatch},
+		{0, ErrUnknownReply},
+	}
+
+	for _, tt := range tests {
+		if err := ReplyErr(tt.reply); !errors.Is(err, tt.want) {
+			t.Errorf("ReplyErr(%d) = %v, want %v", tt.reply, err, tt.want)
+		}
+	}
+}
+
+func TestDialContextWithConn(t *testing.T) {
+	tests := []struct {
+		reply byte
+		want  error
+	}{
+		{ReplyOK, nil},
+		{ReplyRejected, ErrRejected},
+		{ReplyIdentUnreachable, ErrIdentUnreachable},
+		{ReplyIdentMismatch, ErrIdentMismatch},
+	}
+
+	for _, tt := range tests {
+		client, server := net.Pipe()
+
+		go func() {
+			defer server.Close()
+			// version, cmd, port, ip, empty id, hostname
+			buf := make([]byte, 8+1+len("example.com")+1)
+			if _, err := io.ReadFull(server, buf); err != nil {
+				return
+			}
+			server.Write([]byte{0, tt.reply, 0x1f, 0x90, 10, 0, 0, 1})
+		}()
+
+		d := NewDialer("tcp", "127.0.0.1:1080", nil, Config{T: TypeA})
+		conn, err := d.DialContextWithConn(context.Background(), client, "tcp", "example.com:80")
+		if !errors.Is(err, tt.want) {
+			t.Fatalf("reply %d: got error %v, want %v", tt.reply, err, tt.want)
+		}
+
+		if err == nil {
+			if got := conn.LocalAddr().String(); got != "10.0.0.1:8080" {
+				t.Errorf("got local address %s, want 10.0.0.1:8080", got)
+			}
+			if got := conn.RemoteAddr().String(); got != "example.com:80" {
+				t.Errorf("got remote address %s, want example.com:80", got)
+			}
+			conn.Close()
+		}
+
+		client.Close()
+	}
+}
@@ -0,0 +1,124 @@
+package socks4
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+type Server struct {
+	// if set, requests are rejected unless Allow returns true
+	Allow func(id string) bool
+}
+
+type Request struct {
+	Cmd  byte
+	Addr Addr
+	ID   string
+}
+
+// Handle reads the client request. Valid requests are not replied, the
+// caller must reply once connected
+func (s *Server) Handle(conn net.Conn) (Request, error) {
+	reply, req, err := s.GetRequest(conn)
+	if err != nil {
+		return req, err
+	}
+
+	if reply == ReplyOK {
+		return req, nil
+	}
+
+	if err := s.Reply(conn, reply, LocalAddr(conn)); err != nil {
+		return req, err
+	}
+
+	return req, ReplyErr(reply)
+}
+
+// LocalAddr returns the ipv4 address of conn replied to clients
+func LocalAddr(conn net.Conn) Addr {
+	addr := Addr{t: AtypIPv4, host: "0.0.0.0"}
+	if tcpaddr, ok := conn.LocalAddr().(*net.TCPAddr); ok && tcpaddr.IP.To4() != nil {
+		addr.host = tcpaddr.IP.To4().String()
+		addr.port = uint16(tcpaddr.Port)
+	}
+	return addr
+}
+
+func (s *Server) GetRequest(r io.Reader) (byte, Request, error) {
+	req := Request{}
+	buf := make([]byte, 2+2+net.IPv4len)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return ReplyRejected, req, err
+	}
+
+	if buf[0] != Version {
+		return ReplyRejected, req, errors.New("unknown request version")
+	}
+
+	req.Cmd = buf[1]
+	req.Addr.port = binary.BigEndian.Uint16(buf[2:4])
+	ip := net.IPv4(buf[4], buf[5], buf[6], buf[7])
+
+	id, err := readString(r)
+	if err != nil {
+		return ReplyRejected, req, err
+	}
+	req.ID = id
+
+	// socks4a: 0.0.0.x with x != 0 means a hostname follows
+	if buf[4] == 0 && buf[5] == 0 && buf[6] == 0 && buf[7] != 0 {
+		host, err := readString(r)
+		if err != nil {
+			return ReplyRejected, req, err
+		}
+		req.Addr.t = AtypDomainName
+		req.Addr.host = host
+	} else {
+		req.Addr.t = AtypIPv4
+		req.Addr.host = ip.String()
+	}
+
+	if req.Cmd != CmdConnect {
+		return ReplyRejected, req, nil
+	}
+
+	if s.Allow != nil && !s.Allow(req.ID) {
+		return ReplyRejected, req, nil
+	}
+
+	return ReplyOK, req, nil
+}
+
+func (s *Server) Reply(w io.Writer, reply byte, addr Addr) error {
+	buf := make([]byte, 0, 2+2+net.IPv4len)
+	buf = append(buf, 0, reply)
+	buf = binary.BigEndian.AppendUint16(buf, addr.port)
+	ip := net.ParseIP(addr.host).To4()
+	if ip == nil {
+		ip = net.IPv4zero.To4()
+	}
+	buf = append(buf, ip...)
+	_, err := w.Write(buf)
+	return err
+}
+
+// reads a null terminated string
+func readString(r io.Reader) (string, error) {
+	buf := make([]byte, 0, 32)
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(buf), nil
+		}
+		if len(buf) == 255 {
+			return "", errors.New("string is too long")
+		}
+		buf = append(buf, b[0])
+	}
+}
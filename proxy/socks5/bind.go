@@ -0,0 +1,60 @@
+package socks5
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+type Bind struct {
+	d         *Dialer
+	bnd       Addr
+	conn      net.Conn
+	mutex     sync.Mutex
+	accepting bool
+	accepted  bool
+}
+
+func (b *Bind) Accept() (net.Conn, error) {
+	b.mutex.Lock()
+	if b.accepting {
+		b.mutex.Unlock()
+		return nil, errors.New("socks5: bind can only be accepted once")
+	}
+	b.accepting = true
+	b.mutex.Unlock()
+
+	reply, remote, err := b.d.response(b.conn)
+	if err == nil {
+		err = reply.Err()
+	}
+
+	if err != nil {
+		b.conn.Close()
+		return nil, err
+	}
+
+	b.mutex.Lock()
+	b.accepted = true
+	b.mutex.Unlock()
+
+	c := new(Conn)
+	c.bnd = b.bnd
+	c.remote = remote
+	c.conn = b.conn
+	return c, nil
+}
+
+// Close does not close the accepted connection
+func (b *Bind) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.accepted {
+		return nil
+	}
+	return b.conn.Close()
+}
+
+func (b *Bind) Addr() net.Addr {
+	return &b.bnd
+}
@@ -3,9 +3,11 @@ package socks5
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"math"
 	"net"
+	"strconv"
 )
 
 type Dialer struct {
@@ -15,12 +17,24 @@ type Dialer struct {
 	kwargs  map[string]string
 }
 
+type Resolver interface {
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
 type Config struct {
 	Methods  []Method
 	Username string
 	Password string
+	T        int
+	// used to resolve hostnames for socks5, defaults to net.DefaultResolver
+	Resolver Resolver
 }
 
+const (
+	// hostnames are resolved by the proxy
+	TypeH = 1
+)
+
 func NewDialer(network, address string, kwargs map[string]string, config Config) *Dialer {
 	d := new(Dialer)
 	d.network = network
@@ -35,7 +49,12 @@ func (d *Dialer) KWArgs() map[string]string {
 }
 
 func (d *Dialer) Protocol() string {
-	return "socks5"
+	switch d.config.T {
+	case TypeH:
+		return "socks5h"
+	default:
+		return "socks5"
+	}
 }
 
 func (d *Dialer) String() string {
@@ -161,13 +180,35 @@ func (d *Dialer) userPassAuth(rw io.ReadWriter) error {
 	if buf[0] != VersionUserPass {
 		return errors.New("unknown username/password version")
 	}
-	if buf[1] != 0x00 {
+	if buf[1] != StatusUserPassOK {
 		return errors.New("invalid username/password")
 	}
 
 	return nil
 }
 
+func (d *Dialer) handshake(conn net.Conn, cmd Command, address string) (Addr, error) {
+	method, err := d.negotiateMethods(conn)
+	if err != nil {
+		return Addr{}, err
+	}
+
+	if err = d.handleAuth(conn, method); err != nil {
+		return Addr{}, err
+	}
+
+	if err = d.request(conn, cmd, address); err != nil {
+		return Addr{}, err
+	}
+
+	reponse, bnd, err := d.response(conn)
+	if err != nil {
+		return Addr{}, err
+	}
+
+	return bnd, reponse.Err()
+}
+
 func (d *Dialer) DialContextWithConn(ctx context.Context, conn net.Conn, network, address string) (net.Conn, error) {
 	if network != "tcp" {
 		return nil, errors.New("tcp only")
@@ -182,33 +223,76 @@ func (d *Dialer) DialContextWithConn(ctx context.Context, conn net.Conn, network
 
 	go func() {
 		defer close(cresult)
-		method, err := d.negotiateMethods(conn)
+		address, err := d.resolve(ctx, address)
 		if err != nil {
 			cresult <- result{err: err}
 			return
 		}
 
-		if err = d.handleAuth(conn, method); err != nil {
+		bnd, err := d.handshake(conn, CmdConnect, address)
+		if err != nil {
 			cresult <- result{err: err}
 			return
 		}
 
-		if err = d.request(conn, CmdConnect, address); err != nil {
+		c := new(Conn)
+		c.bnd = bnd
+		c.remote, _ = NewAddress(address)
+		c.conn = conn
+		cresult <- result{conn: c}
+	}()
+
+	select {
+	case <-ctx.Done():
+		conn.Close()
+		return nil, ctx.Err()
+	case result := <-cresult:
+		return result.conn, result.err
+	}
+
+}
+
+// ListenPacketWithConn requests a UDP association over conn. Datagrams are
+// sent directly to the relay address replied by the proxy
+func (d *Dialer) ListenPacketWithConn(ctx context.Context, conn net.Conn) (net.PacketConn, error) {
+	type result struct {
+		err   error
+		pconn net.PacketConn
+	}
+
+	cresult := make(chan result, 1)
+
+	go func() {
+		defer close(cresult)
+		bnd, err := d.handshake(conn, CmdUDPAssociate, "0.0.0.0:0")
+		if err != nil {
 			cresult <- result{err: err}
 			return
 		}
 
-		reponse, bnd, err := d.response(conn)
+		bnd, err = d.fixUnspecified(bnd)
 		if err != nil {
 			cresult <- result{err: err}
 			return
 		}
 
-		c := new(Conn)
-		c.bnd = bnd
-		c.remote, _ = NewAddress(address)
-		c.conn = conn
-		cresult <- result{conn: c, err: reponse.Err()}
+		relay, err := net.ResolveUDPAddr("udp", bnd.String())
+		if err != nil {
+			cresult <- result{err: err}
+			return
+		}
+
+		pconn, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			cresult <- result{err: err}
+			return
+		}
+
+		c := NewPacketConn(conn, pconn, relay)
+		if d.config.T != TypeH {
+			c.resolve = d.resolve
+		}
+		cresult <- result{pconn: c}
 	}()
 
 	select {
@@ -216,9 +300,117 @@ func (d *Dialer) DialContextWithConn(ctx context.Context, conn net.Conn, network
 		conn.Close()
 		return nil, ctx.Err()
 	case result := <-cresult:
-		return result.conn, result.err
+		if result.err != nil {
+			conn.Close()
+		}
+		return result.pconn, result.err
+	}
+}
+
+// BindWithConn sends a BIND request over conn. The returned listener's Addr
+// is the address the proxy listens on, Accept waits for the proxy's second
+// reply and can only be called once
+func (d *Dialer) BindWithConn(ctx context.Context, conn net.Conn, address string) (net.Listener, error) {
+	type result struct {
+		err error
+		l   net.Listener
+	}
+
+	cresult := make(chan result, 1)
+
+	go func() {
+		defer close(cresult)
+		address, err := d.resolve(ctx, address)
+		if err != nil {
+			cresult <- result{err: err}
+			return
+		}
+
+		bnd, err := d.handshake(conn, CmdBind, address)
+		if err != nil {
+			cresult <- result{err: err}
+			return
+		}
+
+		bnd, err = d.fixUnspecified(bnd)
+		if err != nil {
+			cresult <- result{err: err}
+			return
+		}
+
+		l := new(Bind)
+		l.d = d
+		l.bnd = bnd
+		l.conn = conn
+		cresult <- result{l: l}
+	}()
+
+	select {
+	case <-ctx.Done():
+		conn.Close()
+		return nil, ctx.Err()
+	case result := <-cresult:
+		if result.err != nil {
+			conn.Close()
+		}
+		return result.l, result.err
+	}
+}
+
+// resolve replaces the hostname of address with one of its ips, unless the
+// proxy is expected to resolve it
+func (d *Dialer) resolve(ctx context.Context, address string) (string, error) {
+	if d.config.T == TypeH {
+		return address, nil
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+
+	if net.ParseIP(host) != nil {
+		return address, nil
+	}
+
+	var resolver Resolver = net.DefaultResolver
+	if d.config.Resolver != nil {
+		resolver = d.config.Resolver
+	}
+
+	ips, err := resolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return "", err
+	}
+
+	if len(ips) == 0 {
+		return "", fmt.Errorf("could not resolve %s", host)
+	}
+
+	ip := ips[0]
+	for _, i := range ips {
+		if i.To4() != nil {
+			ip = i
+			break
+		}
+	}
+
+	return net.JoinHostPort(ip.String(), port), nil
+}
+
+// replaces an unspecified bound address with the proxy's host
+func (d *Dialer) fixUnspecified(a Addr) (Addr, error) {
+	ip := net.ParseIP(a.addr)
+	if ip == nil || !ip.IsUnspecified() {
+		return a, nil
+	}
+
+	host, _, err := net.SplitHostPort(d.address)
+	if err != nil {
+		return Addr{}, err
 	}
 
+	return NewAddress(net.JoinHostPort(host, strconv.Itoa(int(a.port))))
 }
 
 func (c *Config) hasMethod(method Method) bool {
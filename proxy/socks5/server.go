@@ -2,67 +2,171 @@ package socks5
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+type Authenticator interface {
+	Authenticate(username, password string) bool
+}
+
+var (
+	ErrAuthFailed          = errors.New("authentication failed")
+	ErrNoAcceptableMethods = errors.New("no supported methods")
 )
 
 type Server struct {
+	// if set, clients must authenticate with username/password
+	Auth Authenticator
 }
 
-func (s *Server) Handle(conn net.Conn) (Addr, error) {
-	if err := s.NegotiateMethods(conn); err != nil {
-		return Addr{}, err
+type Request struct {
+	Cmd      Command
+	Addr     Addr
+	Username string
+	// relay socket for CmdUDPAssociate requests
+	PacketConn net.PacketConn
+}
+
+// Handle negotiates and reads the client request. Valid requests are not
+// replied, the caller must reply once connected. CmdUDPAssociate requests
+// get a relay socket in PacketConn, whose address is the one to reply with.
+// For CmdBind see Bind
+func (s *Server) Handle(conn net.Conn) (Request, error) {
+	req := Request{}
+
+	method, err := s.NegotiateMethods(conn)
+	if err != nil {
+		return req, err
 	}
 
-	reply, _, addr, err := s.GetRequest(conn)
+	if method == MethodUserPass {
+		req.Username, err = s.UserPassAuth(conn)
+		if err != nil {
+			return req, err
+		}
+	}
+
+	reply, cmd, addr, err := s.GetRequest(conn)
 	if err != nil {
-		return Addr{}, err
+		return req, err
 	}
 
+	req.Cmd = cmd
+	req.Addr = addr
+
 	bnd, _ := NewAddress(conn.LocalAddr().String())
 
-	if err := s.Reply(conn, reply, bnd); err != nil {
-		return Addr{}, err
+	if reply == ReplyOK && cmd == CmdUDPAssociate {
+		pconn, err := net.ListenPacket("udp", net.JoinHostPort(bnd.addr, "0"))
+		if err != nil {
+			s.Reply(conn, ReplyGeneralFailure, bnd)
+			return req, err
+		}
+		req.PacketConn = pconn
 	}
 
-	if reply != ReplyOK {
-		return Addr{}, reply.Err()
+	if reply == ReplyOK {
+		return req, nil
 	}
 
-	return addr, nil
+	if err := s.Reply(conn, reply, bnd); err != nil {
+		return req, err
+	}
+
+	return req, reply.Err()
 }
 
-func (s *Server) NegotiateMethods(rw io.ReadWriter) error {
+func (s *Server) NegotiateMethods(rw io.ReadWriter) (Method, error) {
 	buf := make([]byte, 2+255)
 	if _, err := io.ReadFull(rw, buf[:2]); err != nil {
-		return err
+		return MethodNotAcceptable, err
 	}
 
 	if buf[0] != Version {
-		return errors.New("unknown method version")
+		return MethodNotAcceptable, errors.New("unknown method version")
 	}
 
 	nmethods := int(buf[1])
 	if nmethods == 0 {
-		return errors.New("no methods")
+		return MethodNotAcceptable, errors.New("no methods")
 	}
 
 	methods := make([]Method, nmethods)
 	if _, err := io.ReadFull(rw, buf[:nmethods]); err != nil {
-		return err
+		return MethodNotAcceptable, err
 	}
 	for i, b := range buf[:nmethods] {
 		methods[i] = Method(b)
 	}
 
-	if !hasMethod(methods, MethodNoAuth) {
-		return errors.New("no supported methods")
+	method := MethodNoAuth
+	if s.Auth != nil {
+		method = MethodUserPass
+	}
+
+	if !hasMethod(methods, method) {
+		method = MethodNotAcceptable
 	}
+
 	buf = buf[:0]
 	buf = append(buf, Version)
-	buf = append(buf, byte(MethodNoAuth))
-	_, err := rw.Write(buf)
-	return err
+	buf = append(buf, byte(method))
+	if _, err := rw.Write(buf); err != nil {
+		return method, err
+	}
+
+	if method == MethodNotAcceptable {
+		return method, ErrNoAcceptableMethods
+	}
+
+	return method, nil
+}
+
+func (s *Server) UserPassAuth(rw io.ReadWriter) (string, error) {
+	buf := make([]byte, 255)
+	if _, err := io.ReadFull(rw, buf[:2]); err != nil {
+		return "", err
+	}
+
+	if buf[0] != VersionUserPass {
+		return "", errors.New("unknown username/password version")
+	}
+
+	ulen := int(buf[1])
+	if _, err := io.ReadFull(rw, buf[:ulen]); err != nil {
+		return "", err
+	}
+	username := string(buf[:ulen])
+
+	if _, err := io.ReadFull(rw, buf[:1]); err != nil {
+		return "", err
+	}
+
+	plen := int(buf[0])
+	if _, err := io.ReadFull(rw, buf[:plen]); err != nil {
+		return "", err
+	}
+	password := string(buf[:plen])
+
+	status := StatusUserPassOK
+	if s.Auth == nil || !s.Auth.Authenticate(username, password) {
+		status = StatusUserPassFailure
+	}
+
+	if _, err := rw.Write([]byte{VersionUserPass, status}); err != nil {
+		return "", err
+	}
+
+	if status != StatusUserPassOK {
+		return "", fmt.Errorf("%w for user %q", ErrAuthFailed, username)
+	}
+
+	return username, nil
 }
 
 func (s *Server) GetRequest(rw io.ReadWriter) (Reply, Command, Addr, error) {
@@ -78,7 +182,9 @@ func (s *Server) GetRequest(rw io.ReadWriter) (Reply, Command, Addr, error) {
 	}
 
 	cmd := Command(buf[1])
-	if cmd != CmdConnect {
+	switch cmd {
+	case CmdConnect, CmdBind, CmdUDPAssociate:
+	default:
 		return ReplyCmdNotSupported, cmd, Addr{}, nil
 	}
 
@@ -102,6 +208,177 @@ func (s *Server) Reply(rw io.ReadWriter, reply Reply, address Addr) error {
 	return nil
 }
 
+// Bind sends the first BIND reply with l's address, waits for the incoming
+// connection and sends the second reply with its address. l is closed if
+// the client disconnects while waiting
+func (s *Server) Bind(conn net.Conn, l net.Listener, dst Addr) (net.Conn, error) {
+	defer l.Close()
+
+	bnd, err := bindAddress(conn, l)
+	if err != nil {
+		s.Reply(conn, ReplyGeneralFailure, Addr{atyp: AtypIPV4, addr: "0.0.0.0"})
+		return nil, err
+	}
+
+	if err := s.Reply(conn, ReplyOK, bnd); err != nil {
+		return nil, err
+	}
+
+	// nothing is expected from the client until the second reply, stop
+	// waiting for the incoming connection if it disconnects
+	stop := make(chan struct{})
+	cerr := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		select {
+		case <-stop:
+		default:
+			l.Close()
+		}
+		cerr <- err
+	}()
+
+	rconn, err := l.Accept()
+	close(stop)
+	conn.SetReadDeadline(time.Now())
+	clienterr := <-cerr
+	conn.SetReadDeadline(time.Time{})
+
+	if !errors.Is(clienterr, os.ErrDeadlineExceeded) {
+		if rconn != nil {
+			rconn.Close()
+		}
+		if clienterr == nil {
+			clienterr = errors.New("client sent data before the second bind reply")
+		}
+		return nil, fmt.Errorf("bind: %w", clienterr)
+	}
+
+	if err != nil {
+		s.Reply(conn, ReplyGeneralFailure, bnd)
+		return nil, err
+	}
+
+	remote, err := NewAddress(rconn.RemoteAddr().String())
+	if err != nil {
+		rconn.Close()
+		s.Reply(conn, ReplyGeneralFailure, bnd)
+		return nil, err
+	}
+
+	// only the host given in the request may connect. Hostnames are not
+	// resolved, so they are not checked
+	want := net.ParseIP(dst.addr)
+	if want != nil && !want.IsUnspecified() && !want.Equal(net.ParseIP(remote.addr)) {
+		rconn.Close()
+		s.Reply(conn, ReplyConnNotAllowed, bnd)
+		return nil, fmt.Errorf("bind: connection from %s, expected %s", remote.String(), dst.addr)
+	}
+
+	if err := s.Reply(conn, ReplyOK, remote); err != nil {
+		rconn.Close()
+		return nil, err
+	}
+
+	return rconn, nil
+}
+
+// bindAddress returns the address of l sent to the client. An unspecified
+// ip is replaced with the one the client connected to
+func bindAddress(conn net.Conn, l net.Listener) (Addr, error) {
+	host, port, err := net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		return Addr{}, err
+	}
+
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		host, _, err = net.SplitHostPort(conn.LocalAddr().String())
+		if err != nil {
+			return Addr{}, err
+		}
+	}
+
+	return NewAddress(net.JoinHostPort(host, port))
+}
+
+// RelayUDP forwards datagrams between the client and upstream until the
+// control connection is closed. Datagrams from the client to addresses allow
+// returns false for are dropped, allow may be nil
+func (s *Server) RelayUDP(conn net.Conn, client, upstream net.PacketConn, allow func(address string) bool) error {
+	var (
+		mutex      sync.Mutex
+		clientaddr net.Addr
+	)
+
+	clienthost, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		buf := make([]byte, MaxDatagramSize)
+		for {
+			n, from, err := client.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			host, _, _ := net.SplitHostPort(from.String())
+			if host != clienthost {
+				continue
+			}
+
+			frag, addr, data, err := ParseDatagram(buf[:n])
+			if err != nil || frag != 0 {
+				continue
+			}
+
+			if allow != nil && !allow(addr.String()) {
+				continue
+			}
+
+			mutex.Lock()
+			clientaddr = from
+			mutex.Unlock()
+
+			upstream.WriteTo(data, &addr)
+		}
+	}()
+
+	go func() {
+		buf := make([]byte, MaxDatagramSize)
+		for {
+			n, from, err := upstream.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			mutex.Lock()
+			to := clientaddr
+			mutex.Unlock()
+
+			if to == nil {
+				continue
+			}
+
+			addr, err := NewAddress(from.String())
+			if err != nil {
+				continue
+			}
+
+			client.WriteTo(AppendDatagram(nil, addr, buf[:n]), to)
+		}
+	}()
+
+	_, err = io.Copy(io.Discard, conn)
+	client.Close()
+	upstream.Close()
+	if errors.Is(err, net.ErrClosed) {
+		err = nil
+	}
+	return err
+}
+
 func hasMethod(methods []Method, method Method) bool {
 	for _, m := range methods {
 		if m == method {
@@ -10,7 +10,9 @@ import (
 )
 
 const (
-	CmdConnect Command = 0x01
+	CmdConnect      Command = 0x01
+	CmdBind         Command = 0x02
+	CmdUDPAssociate Command = 0x03
 
 	AtypIPV4       AddressType = 0x01
 	AtypDomainName AddressType = 0x03
@@ -23,6 +25,9 @@ const (
 	Version         byte = 0x05
 	VersionUserPass byte = 0x01
 
+	StatusUserPassOK      byte = 0x00
+	StatusUserPassFailure byte = 0x01
+
 	ReplyOK                 Reply = 0x00
 	ReplyGeneralFailure     Reply = 0x01
 	ReplyConnNotAllowed     Reply = 0x02
@@ -158,27 +163,38 @@ func (m Method) isValid() bool {
 	}
 }
 
+// Err returns nil for ReplyOK, a *ReplyError otherwise
 func (r Reply) Err() error {
-	switch r {
+	if r == ReplyOK {
+		return nil
+	}
+	return &ReplyError{Reply: r}
+}
+
+// ReplyError is a request that failed with Reply
+type ReplyError struct {
+	Reply Reply
+}
+
+func (e *ReplyError) Error() string {
+	switch e.Reply {
 	case ReplyTTLExpired:
-		return errors.New("TTL expired")
+		return "TTL expired"
 	case ReplyNetworkUnreachable:
-		return errors.New("network unreachable")
+		return "network unreachable"
 	case ReplyHostUnreachable:
-		return errors.New("host unreachable")
+		return "host unreachable"
 	case ReplyGeneralFailure:
-		return errors.New("general failure")
+		return "general failure"
 	case ReplyConnRefused:
-		return errors.New("connection refused")
+		return "connection refused"
 	case ReplyConnNotAllowed:
-		return errors.New("connection not allowed")
+		return "connection not allowed"
 	case ReplyCmdNotSupported:
-		return errors.New("command not supported")
+		return "command not supported"
 	case ReplyAtypNotSupported:
-		return errors.New("address type not supported")
-	case ReplyOK:
-		return nil
+		return "address type not supported"
 	default:
-		return errors.New("unknown reply")
+		return "unknown reply"
 	}
 }
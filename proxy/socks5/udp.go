@@ -0,0 +1,131 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+const MaxDatagramSize = 65535
+
+// PacketConn sends and receives datagrams through a socks5 UDP relay. The
+// association lasts as long as the control connection is open
+type PacketConn struct {
+	conn  net.Conn
+	pconn net.PacketConn
+	relay net.Addr
+	// if set, hostnames are resolved before sending
+	resolve func(context.Context, string) (string, error)
+}
+
+func NewPacketConn(conn net.Conn, pconn net.PacketConn, relay net.Addr) *PacketConn {
+	c := new(PacketConn)
+	c.conn = conn
+	c.pconn = pconn
+	c.relay = relay
+
+	go func() {
+		io.Copy(io.Discard, conn)
+		pconn.Close()
+	}()
+
+	return c
+}
+
+func (c *PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, MaxDatagramSize)
+
+	for {
+		n, from, err := c.pconn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if from.String() != c.relay.String() {
+			continue
+		}
+
+		frag, addr, data, err := ParseDatagram(buf[:n])
+		if err != nil || frag != 0 {
+			continue
+		}
+
+		return copy(b, data), &addr, nil
+	}
+}
+
+func (c *PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	address := addr.String()
+
+	if c.resolve != nil {
+		var err error
+		address, err = c.resolve(context.Background(), address)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	a, err := NewAddress(address)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := c.pconn.WriteTo(AppendDatagram(nil, a, b), c.relay); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+func (c *PacketConn) Close() error {
+	err := c.pconn.Close()
+	c.conn.Close()
+	return err
+}
+
+func (c *PacketConn) LocalAddr() net.Addr {
+	return c.pconn.LocalAddr()
+}
+
+func (c *PacketConn) SetDeadline(t time.Time) error {
+	return c.pconn.SetDeadline(t)
+}
+
+func (c *PacketConn) SetReadDeadline(t time.Time) error {
+	return c.pconn.SetReadDeadline(t)
+}
+
+func (c *PacketConn) SetWriteDeadline(t time.Time) error {
+	return c.pconn.SetWriteDeadline(t)
+}
+
+// ParseDatagram decodes the UDP request header described in RFC 1928 section 7
+func ParseDatagram(b []byte) (byte, Addr, []byte, error) {
+	if len(b) < 4 {
+		return 0, Addr{}, nil, errors.New("socks5: datagram is too small")
+	}
+
+	if b[0] != 0 || b[1] != 0 {
+		return 0, Addr{}, nil, errors.New("invalid rsv")
+	}
+
+	frag := b[2]
+
+	r := bytes.NewReader(b[3:])
+	addr, err := ReadAddress(r)
+	if err != nil {
+		return frag, Addr{}, nil, err
+	}
+
+	return frag, addr, b[len(b)-r.Len():], nil
+}
+
+func AppendDatagram(buf []byte, addr Addr, data []byte) []byte {
+	buf = append(buf, 0, 0, 0)
+	buf = append(buf, addr.Bytes()...)
+	buf = append(buf, data...)
+	return buf
+}
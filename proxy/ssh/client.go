@@ -0,0 +1,199 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sync"
+
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Client is the ssh connection to a hop, shared by its dialers. Keys and
+// known_hosts are read once, the connection is made by the first dial and
+// made again once it dies
+type Client struct {
+	address string
+	config  *gossh.ClientConfig
+
+	mutex  sync.Mutex
+	client *gossh.Client
+	// open channels, the connection of a retired client is closed once
+	// there are none
+	active  int
+	retired bool
+}
+
+func NewClient(address string, config Config) (*Client, error) {
+	cc, err := clientConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{address: address, config: cc}, nil
+}
+
+// Retire stops sharing the ssh connection, it is closed once its channels
+// are
+func (c *Client) Retire() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.retired = true
+	if c.active == 0 && c.client != nil {
+		c.client.Close()
+		c.client = nil
+	}
+}
+
+// shared returns the ssh connection if it is up
+func (c *Client) shared() *gossh.Client {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.retired {
+		return nil
+	}
+	return c.client
+}
+
+// connect makes an ssh connection over conn and shares it. If another one
+// was shared meanwhile, that one is returned instead. owned is true if the
+// connection is not shared and must be closed with its channel
+func (c *Client) connect(ctx context.Context, conn net.Conn) (client *gossh.Client, owned bool, err error) {
+	type result struct {
+		err    error
+		client *gossh.Client
+	}
+
+	cresult := make(chan result, 1)
+
+	go func() {
+		defer close(cresult)
+		sconn, chans, reqs, err := gossh.NewClientConn(conn, c.address, c.config)
+		if err != nil {
+			cresult <- result{err: err}
+			return
+		}
+		cresult <- result{client: gossh.NewClient(sconn, chans, reqs)}
+	}()
+
+	select {
+	case <-ctx.Done():
+		conn.Close()
+		return nil, false, ctx.Err()
+	case result := <-cresult:
+		if result.err != nil {
+			return nil, false, result.err
+		}
+		client = result.client
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	switch {
+	case c.retired:
+		return client, true, nil
+	case c.client != nil:
+		client.Close()
+		return c.client, false, nil
+	}
+
+	c.client = client
+
+	go func() {
+		client.Wait()
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		if c.client == client {
+			c.client = nil
+		}
+	}()
+
+	return client, false, nil
+}
+
+// channel opens a direct-tcpip channel to address through client
+func (c *Client) channel(ctx context.Context, client *gossh.Client, owned bool, address string) (net.Conn, error) {
+	ch, err := client.DialContext(ctx, "tcp", address)
+	if err != nil {
+		if owned {
+			client.Close()
+		}
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	c.active += 1
+	c.mutex.Unlock()
+
+	conn := &Conn{Conn: ch, owner: c}
+	if owned {
+		conn.client = client
+	}
+	return conn, nil
+}
+
+func (c *Client) release() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.active -= 1
+	if c.retired && c.active == 0 && c.client != nil {
+		c.client.Close()
+		c.client = nil
+	}
+}
+
+func clientConfig(c Config) (*gossh.ClientConfig, error) {
+	config := new(gossh.ClientConfig)
+	config.User = c.User
+
+	if len(config.User) == 0 {
+		// same as ssh(1)
+		u, err := user.Current()
+		if err != nil {
+			return nil, fmt.Errorf("no user given and the current user is unknown: %w", err)
+		}
+		config.User = u.Username
+	}
+
+	knownhostsfile := c.KnownHosts
+	if len(knownhostsfile) == 0 {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		knownhostsfile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+
+	callback, err := knownhosts.New(knownhostsfile)
+	if err != nil {
+		return nil, err
+	}
+	config.HostKeyCallback = callback
+
+	if len(c.Key) != 0 {
+		data, err := os.ReadFile(c.Key)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := gossh.ParsePrivateKey(data)
+		if err != nil {
+			return nil, err
+		}
+		config.Auth = append(config.Auth, gossh.PublicKeys(signer))
+	}
+
+	if len(c.Password) != 0 {
+		config.Auth = append(config.Auth, gossh.Password(c.Password))
+	}
+
+	if len(config.Auth) == 0 {
+		return nil, errors.New("no authentication methods")
+	}
+
+	return config, nil
+}
@@ -0,0 +1,74 @@
+package ssh
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Conn is a direct-tcpip channel. ssh channels do not support deadlines,
+// Conn closes the channel once one expires instead
+type Conn struct {
+	net.Conn
+	owner *Client
+	// set if the ssh connection is not shared, closed with the channel
+	client *gossh.Client
+
+	once   sync.Once
+	mutex  sync.Mutex
+	rtimer *time.Timer
+	wtimer *time.Timer
+}
+
+func (c *Conn) Close() error {
+	c.mutex.Lock()
+	stopTimer(c.rtimer)
+	stopTimer(c.wtimer)
+	c.mutex.Unlock()
+
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		if c.client != nil {
+			c.client.Close()
+		}
+		c.owner.release()
+	})
+	return err
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.rtimer = c.closeAt(c.rtimer, t)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.wtimer = c.closeAt(c.wtimer, t)
+	return nil
+}
+
+// closeAt replaces timer with one that closes c at t, a zero t means no
+// deadline. c.mutex must be held
+func (c *Conn) closeAt(timer *time.Timer, t time.Time) *time.Timer {
+	stopTimer(timer)
+	if t.IsZero() {
+		return nil
+	}
+	return time.AfterFunc(time.Until(t), func() { c.Close() })
+}
+
+func stopTimer(t *time.Timer) {
+	if t != nil {
+		t.Stop()
+	}
+}
@@ -0,0 +1,87 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+type Config struct {
+	// defaults to the current user
+	User     string
+	Password string
+	// private key file
+	Key string
+	// known_hosts file, defaults to ~/.ssh/known_hosts
+	KnownHosts string
+}
+
+type Dialer struct {
+	address string
+	network string
+	client  *Client
+	kwargs  map[string]string
+}
+
+func NewDialer(network, address string, kwargs map[string]string, client *Client) *Dialer {
+	d := new(Dialer)
+	d.network = network
+	d.address = address
+	d.client = client
+	d.kwargs = kwargs
+	return d
+}
+
+func (d *Dialer) KWArgs() map[string]string {
+	return d.kwargs
+}
+
+func (d *Dialer) Protocol() string {
+	return "ssh"
+}
+
+func (d *Dialer) String() string {
+	return d.address
+}
+
+func (d *Dialer) Network() string {
+	return d.network
+}
+
+// DialShared opens a direct-tcpip channel to address through the shared ssh
+// connection, without dialing the previous proxies. ok is false if the
+// connection is not up
+func (d *Dialer) DialShared(ctx context.Context, network, address string) (net.Conn, bool, error) {
+	client := d.client.shared()
+	if client == nil {
+		return nil, false, nil
+	}
+
+	if network != "tcp" {
+		return nil, true, errors.New("tcp only")
+	}
+
+	conn, err := d.client.channel(ctx, client, false, address)
+	return conn, true, err
+}
+
+// DialContextWithConn opens a direct-tcpip channel to address. The ssh
+// connection made over conn is shared with later dials, unless one already
+// is
+func (d *Dialer) DialContextWithConn(ctx context.Context, conn net.Conn, network, address string) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, errors.New("tcp only")
+	}
+
+	if client := d.client.shared(); client != nil {
+		conn.Close()
+		return d.client.channel(ctx, client, false, address)
+	}
+
+	client, owned, err := d.client.connect(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.client.channel(ctx, client, owned, address)
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// Sticky pins keys (eg. client ip, target host or username) to chains of
+// Picker. New keys are assigned with rendezvous hashing, so the same key
+// maps to the same chain while the set of available chains is unchanged.
+// Pins expire after TTL without use, or as soon as the pinned chain is not
+// available
+type Sticky struct {
+	Picker ChainPicker
+	TTL    time.Duration
+
+	mutex  sync.Mutex
+	pins   map[string]pin
+	pruned time.Time
+}
+
+type pin struct {
+	entry   *Entry
+	expires time.Time
+}
+
+// Next returns the chain pinned to key, of group only if grouped is true.
+// Entries in exclude, such as chains that just failed for key, are not
+// returned and key is pinned to another chain
+func (s *Sticky) Next(key, group string, grouped bool, exclude ...*Entry) *Entry {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+
+	if s.pins == nil {
+		s.pins = map[string]pin{}
+	}
+
+	if now.Sub(s.pruned) > s.TTL {
+		for k, p := range s.pins {
+			if now.After(p.expires) {
+				delete(s.pins, k)
+			}
+		}
+		s.pruned = now
+	}
+
+	pinkey := key
+	if grouped {
+		pinkey += "\x00" + group
+	}
+
+	if p, ok := s.pins[pinkey]; ok && now.Before(p.expires) && p.entry.Available() && !hasEntry(exclude, p.entry) {
+		s.pins[pinkey] = pin{entry: p.entry, expires: now.Add(s.TTL)}
+		return p.entry
+	}
+
+	var (
+		best  *Entry
+		score uint64
+	)
+
+	for _, e := range pool(s.Picker.All(), group, grouped, exclude) {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(e.Chain.String()))
+		if sum := h.Sum64(); best == nil || sum > score {
+			best = e
+			score = sum
+		}
+	}
+
+	if best == nil {
+		delete(s.pins, pinkey)
+		return nil
+	}
+
+	s.pins[pinkey] = pin{entry: best, expires: now.Add(s.TTL)}
+
+	return best
+}
+
+func hasEntry(entries []*Entry, e *Entry) bool {
+	for _, x := range entries {
+		if x == e {
+			return true
+		}
+	}
+	return false
+}
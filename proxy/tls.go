@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// tlsDialer wraps the connection to a proxy in TLS before its handshake
+type tlsDialer struct {
+	ProxyDialer
+	protocol string
+	config   *tls.Config
+}
+
+func (p *ProxyInfo) newTLSDialer(d ProxyDialer) (*tlsDialer, error) {
+	config, err := p.tlsConfig(d.String())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", p.Protocol, err)
+	}
+	return &tlsDialer{ProxyDialer: d, protocol: p.Protocol, config: config}, nil
+}
+
+// tlsConfig returns the cached tls config of p, certificate files are only
+// read the first time
+func (p *ProxyInfo) tlsConfig(address string) (*tls.Config, error) {
+	if p.cache == nil {
+		return tlsConfig(address, p.KWArgs)
+	}
+
+	p.cache.mutex.Lock()
+	defer p.cache.mutex.Unlock()
+
+	if p.cache.tls == nil {
+		config, err := tlsConfig(address, p.KWArgs)
+		if err != nil {
+			return nil, err
+		}
+		p.cache.tls = config
+	}
+
+	return p.cache.tls, nil
+}
+
+func (d *tlsDialer) Protocol() string {
+	return d.protocol
+}
+
+func (d *tlsDialer) handshake(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	tconn := tls.Client(conn, d.config)
+	if err := tconn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	return tconn, nil
+}
+
+func (d *tlsDialer) DialContextWithConn(ctx context.Context, conn net.Conn, network, address string) (net.Conn, error) {
+	tconn, err := d.handshake(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	return d.ProxyDialer.DialContextWithConn(ctx, tconn, network, address)
+}
+
+func (d *tlsDialer) ListenPacketWithConn(ctx context.Context, conn net.Conn) (net.PacketConn, error) {
+	pd, ok := d.ProxyDialer.(PacketDialer)
+	if !ok {
+		return nil, errors.New("udp is not supported")
+	}
+	tconn, err := d.handshake(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	return pd.ListenPacketWithConn(ctx, tconn)
+}
+
+func (d *tlsDialer) BindWithConn(ctx context.Context, conn net.Conn, address string) (net.Listener, error) {
+	bd, ok := d.ProxyDialer.(BindDialer)
+	if !ok {
+		return nil, errors.New("bind is not supported")
+	}
+	tconn, err := d.handshake(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	return bd.BindWithConn(ctx, tconn, address)
+}
+
+func tlsConfig(address string, kwargs map[string]string) (*tls.Config, error) {
+	config := new(tls.Config)
+
+	if servername, ok := kwargs["TLSServerName"]; ok {
+		config.ServerName = servername
+	} else {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		config.ServerName = host
+	}
+
+	if insecure, ok := kwargs["TLSInsecure"]; ok {
+		b, err := strconv.ParseBool(insecure)
+		if err != nil {
+			return nil, fmt.Errorf("TLSInsecure: %w", err)
+		}
+		config.InsecureSkipVerify = b
+	}
+
+	if cafile, ok := kwargs["TLSCA"]; ok {
+		data, err := os.ReadFile(cafile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("TLSCA: no certificates found in %s", cafile)
+		}
+	}
+
+	certfile, hascert := kwargs["TLSCert"]
+	keyfile, haskey := kwargs["TLSKey"]
+	if hascert != haskey {
+		return nil, errors.New("TLSCert and TLSKey must be set together")
+	}
+	if hascert {
+		cert, err := tls.LoadX509KeyPair(certfile, keyfile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// Weighted picks chains randomly, proportionally to their `Weight` kwarg
+// (defaults to 1)
+type Weighted struct {
+	chainList
+	rand *rand.Rand
+}
+
+func (w *Weighted) Next() *Entry {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.pick(w.available("", false))
+}
+
+func (w *Weighted) NextGroup(group string) *Entry {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.pick(w.available(group, true))
+}
+
+func (w *Weighted) pick(entries []*Entry) *Entry {
+	total := 0
+	for _, e := range entries {
+		total += e.Chain.Weight()
+	}
+
+	if total == 0 {
+		return nil
+	}
+
+	if w.rand == nil {
+		w.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+
+	n := w.rand.Intn(total)
+	for _, e := range entries {
+		n -= e.Chain.Weight()
+		if n < 0 {
+			return e
+		}
+	}
+
+	return nil
+}
+
+func (c Chain) Weight() int {
+	if len(c) == 0 {
+		return 0
+	}
+	weight, ok := c[0].KWArgs["Weight"]
+	if !ok {
+		return 1
+	}
+	n, err := strconv.Atoi(weight)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
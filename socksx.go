@@ -6,174 +6,387 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"os"
+	"os/signal"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/sloweax/socksx/auth"
 	"github.com/sloweax/socksx/proxy"
+	"github.com/sloweax/socksx/proxy/http"
+	"github.com/sloweax/socksx/proxy/socks4"
 	"github.com/sloweax/socksx/proxy/socks5"
 )
 
 type StringArray []string
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(runCheck(os.Args[2:]))
+	}
 
 	var (
 		proxy_files StringArray
+		users       StringArray
+		htpasswd    StringArray
+		user_groups StringArray
 		addr        string
+		adminaddr   string
+		admintoken  string
+		admintokenf string
+		metricsaddr string
+		pickername  string
+		health      proxy.HealthCheck
+		breaker     proxy.CircuitBreaker
+		sticky      string
+		stickyttl   time.Duration
+		loglevel    string
+		logformat   string
+		accessfmt   string
 		verbose     bool
+		watch       bool
 		retry       int
 	)
 
 	flag.Var(&proxy_files, "c", "load config file")
+	flag.Var(&users, "u", "require clients to authenticate with `user:pass`")
+	flag.Var(&htpasswd, "htpasswd", "require clients to authenticate with credentials from htpasswd `file` (bcrypt only)")
+	flag.Var(&user_groups, "g", "route authenticated `user:group` through chains of group (set Group name)")
 	flag.StringVar(&addr, "a", "127.0.0.1:1080", "listen on address")
+	flag.StringVar(&adminaddr, "admin", "", "serve the admin API on `address`")
+	flag.StringVar(&admintoken, "admin-token", "", "`token` required by the admin API, also read from $SOCKSX_ADMIN_TOKEN")
+	flag.StringVar(&admintokenf, "admin-token-file", "", "read the admin API token from `file`")
+	flag.StringVar(&metricsaddr, "metrics", "", "serve prometheus metrics on `address` at /metrics")
+	flag.StringVar(&pickername, "picker", "roundrobin", "chain picker (roundrobin, random, weighted, leastconn, latency)")
+	flag.StringVar(&sticky, "sticky", "", "pin chains to the client ip, target host or username (client, target, user)")
+	flag.DurationVar(&stickyttl, "sticky-ttl", 10*time.Minute, "forget pinned chains unused for duration")
 	flag.IntVar(&retry, "r", 0, "if chain connection fails, retry with another one x times")
-	flag.BoolVar(&verbose, "verbose", false, "log additional info")
+	flag.StringVar(&health.Target, "health-target", "", "periodically check chains by connecting to `address` through them")
+	flag.DurationVar(&health.Interval, "health-interval", 30*time.Second, "interval between health checks")
+	flag.DurationVar(&health.Timeout, "health-timeout", 10*time.Second, "health check timeout")
+	flag.IntVar(&health.Fall, "health-fall", 3, "mark a chain down after x consecutive failed health checks")
+	flag.IntVar(&health.Rise, "health-rise", 2, "mark a chain up after x consecutive successful health checks")
+	flag.IntVar(&health.Workers, "health-workers", 16, "check x chains at the same time")
+	flag.IntVar(&breaker.Threshold, "breaker-threshold", 0, "take a chain out of rotation after x consecutive connection failures (0 disables)")
+	flag.DurationVar(&breaker.Backoff, "breaker-backoff", 10*time.Second, "how long a chain is out of rotation, doubled each time it fails again")
+	flag.DurationVar(&breaker.MaxBackoff, "breaker-max-backoff", 5*time.Minute, "maximum breaker backoff")
+	flag.BoolVar(&watch, "watch", false, "reload config files when they change (linux only)")
+	flag.StringVar(&loglevel, "log-level", "info", "minimum log `level` (debug, info, warn, error)")
+	flag.StringVar(&logformat, "log-format", "logfmt", "log format (logfmt, json)")
+	flag.StringVar(&accessfmt, "access-format", "", "write access log lines to stdout with go `template` instead of logging them")
+	flag.BoolVar(&verbose, "verbose", false, "same as -log-level debug")
 	flag.Parse()
 
-	picker := proxy.RoundRobin{}
+	if verbose {
+		loglevel = "debug"
+	}
 
-	for _, file := range proxy_files {
-		f, err := os.Open(file)
-		if err != nil {
-			log.Fatal(err)
-		}
+	loghandler, err := newLogHandler(os.Stderr, logformat, loglevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	slog.SetDefault(slog.New(loghandler))
+
+	access, err := newAccessLog(os.Stdout, accessfmt)
+	if err != nil {
+		fatal("invalid access log format", "err", err)
+	}
+
+	groups := map[string]string{}
 
-		if err := picker.Load(f); err != nil {
-			log.Fatal(err)
+	for _, usergroup := range user_groups {
+		username, group, ok := strings.Cut(usergroup, ":")
+		if !ok || len(username) == 0 {
+			fatal("invalid user group, expected `user:group`", "group", usergroup)
 		}
+		groups[username] = group
+	}
 
-		f.Close()
+	var picker proxy.ChainPicker
+
+	switch pickername {
+	case "roundrobin":
+		picker = new(proxy.RoundRobin)
+	case "random":
+		picker = new(proxy.Random)
+	case "weighted":
+		picker = new(proxy.Weighted)
+	case "leastconn":
+		picker = new(proxy.LeastConn)
+	case "latency":
+		picker = new(proxy.LowestLatency)
+	default:
+		fatal("unknown picker", "picker", pickername)
 	}
 
+	picker.SetCircuitBreaker(breaker)
+
+	// files are loaded together, rules may route to groups of other files
 	if len(proxy_files) == 0 {
-		log.Print("no specified config files, reading from stdin")
-		err := picker.Load(os.Stdin)
-		if err != nil {
-			log.Fatal(err)
+		slog.Info("no specified config files, reading from stdin")
+		if err := picker.Reload(os.Stdin); err != nil {
+			fatal("could not load config", "file", "-", "err", err)
 		}
+	} else if err := reloadConfig(picker, proxy_files); err != nil {
+		fatal("could not load config", "err", err)
 	}
 
 	if picker.Len() == 0 {
-		log.Fatal("no loaded proxies")
+		fatal("no loaded proxies")
 	}
 
-	if verbose {
-		for i, ps := range picker.All() {
-			chain := make([]string, len(ps))
-			for i, p := range ps {
-				chain[i] = p.String()
-			}
-			log.Printf("chain %d: %s", i, strings.Join(chain, " | "))
+	if err := checkGroups(picker, groups); err != nil {
+		fatal("invalid user group", "err", err)
+	}
+
+	logConfig(picker)
+
+	reload := func() {
+		if len(proxy_files) == 0 {
+			slog.Warn("config was read from stdin, ignoring reload")
+			return
+		}
+		if err := reloadConfig(picker, proxy_files); err != nil {
+			slog.Error("reload failed", "err", err)
+			return
+		}
+		slog.Info("config reloaded", "chains", picker.Len())
+		if err := checkGroups(picker, groups); err != nil {
+			slog.Warn("invalid user group", "err", err)
 		}
+		logConfig(picker)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reload()
+		}
+	}()
+
+	if watch {
+		if len(proxy_files) == 0 {
+			fatal("-watch requires config files")
+		}
+		if err := watchFiles(proxy_files, reload); err != nil {
+			fatal("could not watch config files", "err", err)
+		}
+	}
+
+	if len(health.Target) != 0 {
+		if health.Interval <= 0 || health.Fall < 1 || health.Rise < 1 || health.Workers < 1 {
+			fatal("invalid health check options")
+		}
+		health.Picker = picker
+		go health.Run(context.Background())
+	}
+
+	if len(adminaddr) != 0 {
+		token, err := adminToken(admintoken, admintokenf)
+		if err != nil {
+			fatal("could not read admin token", "err", err)
+		}
+		admin := &Admin{picker: picker, token: token}
+		go func() {
+			fatal("admin server failed", "err", admin.ListenAndServe(adminaddr))
+		}()
+	}
+
+	if len(metricsaddr) != 0 {
+		go func() {
+			fatal("metrics server failed", "err", serveMetrics(metricsaddr))
+		}()
+	}
+
+	credentials := new(auth.Credentials)
+
+	for _, userpass := range users {
+		username, password, err := auth.ParseUserPass(userpass)
+		if err != nil {
+			fatal("invalid user", "err", err)
+		}
+		credentials.Add(username, password)
+	}
+
+	for _, file := range htpasswd {
+		f, err := os.Open(file)
+		if err != nil {
+			fatal("could not open htpasswd", "file", file, "err", err)
+		}
+
+		if err := credentials.Load(f); err != nil {
+			fatal("could not load htpasswd", "file", file, "err", err)
+		}
+
+		f.Close()
+	}
+
+	handler := new(Handler)
+	handler.picker = picker
+	handler.groups = groups
+	handler.retry = retry
+	handler.access = access
+
+	switch sticky {
+	case "":
+	case "client", "target", "user":
+		if sticky == "user" && credentials.Len() == 0 {
+			// every client would share the empty username
+			fatal("-sticky user requires -u or -htpasswd")
+		}
+		handler.sticky = &proxy.Sticky{Picker: picker, TTL: stickyttl}
+		handler.stickymode = sticky
+	default:
+		fatal("unknown sticky mode", "sticky", sticky)
+	}
+
+	handler.socks4 = new(socks4.Server)
+	handler.socks5 = new(socks5.Server)
+	handler.http = new(http.Server)
+
+	if credentials.Len() != 0 {
+		handler.socks5.Auth = credentials
+		handler.http.Auth = credentials
+		// socks4 has no password authentication
+		handler.socks4.Allow = func(string) bool { return false }
 	}
 
-	server := new(socks5.Server)
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
-		log.Fatal(err)
+		fatal("could not listen", "address", addr, "err", err)
 	}
 	defer listener.Close()
 
+	slog.Info("listening", "address", listener.Addr().String())
+
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Print(fmt.Errorf("server: %w", err))
+			slog.Error("accept failed", "err", err)
 			continue
 		}
 
-		go func() {
-			defer conn.Close()
-
-			var (
-				err   error
-				rconn net.Conn
-				proxy *proxy.Dialer
-			)
-
-			raddr, err := server.Handle(conn)
-			if err != nil {
-				log.Print(fmt.Errorf("server: %w", err))
-				return
-			}
-
-			for i := 0; i < retry+1; i++ {
-				var (
-					ctx    context.Context
-					cancel context.CancelFunc
-				)
-
-				chain := picker.Next()
-				proxy, err = chain.ToDialer()
-				if err != nil {
-					log.Print(fmt.Errorf("server: %w", err))
-					return
-				}
-
-				timeoutstr, ok := chain[0].KWArgs["ChainConnTimeout"]
-				if ok {
-					duration, err := time.ParseDuration(timeoutstr)
-					if err != nil {
-						log.Print(err)
-						return
-					}
-					ctx, cancel = context.WithTimeout(context.Background(), duration)
-					defer cancel()
-				} else {
-					ctx = context.Background()
-				}
-
-				rconn, err = proxy.DialContext(ctx, "tcp", raddr.String())
-				if err != nil {
-					log.Print(err)
-					continue
-				}
-				defer rconn.Close()
-
-				log.Print(fmt.Sprintf("connection from %s to %s (%s)", conn.RemoteAddr(), raddr.String(), proxy.String()))
-
-				break
-			}
-
-			if err != nil {
-				return
-			}
-
-			err = Bridge(conn, rconn)
-
-			if err != nil {
-				log.Print(err)
-			}
-		}()
+		go handler.Serve(conn)
+	}
+}
+
+// logConfig logs the chains and rules of picker at debug level
+func logConfig(picker proxy.ChainPicker) {
+	for _, e := range picker.All() {
+		chain := make([]string, len(e.Chain))
+		for i, p := range e.Chain {
+			chain[i] = p.String()
+		}
+		slog.Debug("chain", "id", e.ID, "chain", strings.Join(chain, " | "))
+	}
+	for _, r := range picker.Rules() {
+		slog.Debug("rule", "rule", r.String())
+	}
+}
+
+// checkGroups returns an error for the groups of users (-g) without chains
+func checkGroups(picker proxy.ChainPicker, groups map[string]string) error {
+	have := map[string]bool{}
+	for _, e := range picker.All() {
+		have[e.Chain.Group()] = true
+	}
+
+	users := make([]string, 0, len(groups))
+	for user := range groups {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+
+	var errs []error
+	for _, user := range users {
+		if !have[groups[user]] {
+			errs = append(errs, fmt.Errorf("group %q of user %q has no chains", groups[user], user))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// reloadConfig replaces the chains of picker with the ones from files
+func reloadConfig(picker proxy.ChainPicker, files []string) error {
+	readers := make([]io.Reader, 0, len(files))
+
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		readers = append(readers, f)
 	}
+
+	return picker.Reload(readers...)
+}
+
+// BridgeStats describes a finished Bridge
+type BridgeStats struct {
+	// bytes copied from a to b and from b to a
+	Up, Down int64
+	// side that closed first, "client" (a) or "target" (b)
+	Closed string
 }
 
-func Bridge(a, b io.ReadWriteCloser) error {
-	done := make(chan error, 2)
+func Bridge(a, b io.ReadWriteCloser) (BridgeStats, error) {
+	type result struct {
+		side string
+		n    int64
+		err  error
+	}
+
+	var (
+		once   sync.Once
+		closed string
+	)
+
+	done := make(chan result, 2)
 
 	defer close(done)
 
-	copy := func(a, b io.ReadWriteCloser, done chan error) {
-		_, err := io.Copy(a, b)
+	copy := func(a, b io.ReadWriteCloser, direction, side string, done chan result) {
+		n, err := io.Copy(&byteCounter{w: a, direction: direction}, b)
+		// the side read from closed first, unless the other copy already
+		// closed both
+		once.Do(func() { closed = side })
 		a.Close()
 		b.Close()
-		done <- err
+		done <- result{side, n, err}
 	}
 
-	go copy(a, b, done)
-	go copy(b, a, done)
+	go copy(a, b, "down", "target", done)
+	go copy(b, a, "up", "client", done)
+
+	first := <-done
+	second := <-done
+
+	stats := BridgeStats{Closed: closed}
+	for _, r := range []result{first, second} {
+		if r.side == "client" {
+			stats.Up = r.n
+		} else {
+			stats.Down = r.n
+		}
+	}
 
-	err := <-done
-	err2 := <-done
-	if err2 == nil {
+	err := first.err
+	if second.err == nil {
 		err = nil
 	}
 	if errors.Is(err, net.ErrClosed) {
 		err = nil
 	}
-	return err
+	return stats, err
 }
 
 func (a *StringArray) String() string {
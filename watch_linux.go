@@ -0,0 +1,92 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// how long to wait for more changes before calling fn, as editors may write
+// a file in several steps
+const watchDelay = 500 * time.Millisecond
+
+// watchFiles calls fn after any of files is written, created or replaced.
+// The directories of files are watched, so files replaced by renaming are
+// still tracked
+func watchFiles(files []string, fn func()) error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("inotify: %w", err)
+	}
+
+	names := map[int32]map[string]bool{}
+
+	for _, file := range files {
+		dir, name := filepath.Split(filepath.Clean(file))
+		if len(dir) == 0 {
+			dir = "."
+		}
+
+		wd, err := unix.InotifyAddWatch(fd, dir, unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO|unix.IN_CREATE|unix.IN_DELETE)
+		if err != nil {
+			unix.Close(fd)
+			return fmt.Errorf("inotify: %s: %w", dir, err)
+		}
+
+		if names[int32(wd)] == nil {
+			names[int32(wd)] = map[string]bool{}
+		}
+		names[int32(wd)][name] = true
+	}
+
+	changed := make(chan struct{}, 1)
+
+	go func() {
+		defer unix.Close(fd)
+		buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+		for {
+			n, err := unix.Read(fd, buf)
+			if err == unix.EINTR {
+				continue
+			}
+			if err != nil {
+				slog.Error("could not watch config files", "err", err)
+				return
+			}
+
+			for off := 0; off+unix.SizeofInotifyEvent <= n; {
+				event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+				off += unix.SizeofInotifyEvent
+				name := strings.TrimRight(string(buf[off:off+int(event.Len)]), "\x00")
+				off += int(event.Len)
+
+				if names[event.Wd][name] {
+					select {
+					case changed <- struct{}{}:
+					default:
+					}
+				}
+			}
+		}
+	}()
+
+	go func() {
+		for range changed {
+			time.Sleep(watchDelay)
+			select {
+			case <-changed:
+			default:
+			}
+			fn()
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func watchFiles(files []string, fn func()) error {
+	return errors.New("watching config files is only supported on linux")
+}